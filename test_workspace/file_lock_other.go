@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "runtime"
+)
+
+// lockFile reports that advisory locks are unavailable, e.g. on solaris or wasm
+func lockFile(file *os.File, block bool) error {
+    return fmt.Errorf("file locking on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
+
+// unlockFile is never reached since lockFile always fails
+func unlockFile(file *os.File) error {
+    return fmt.Errorf("file locking on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+// lockFile takes an exclusive flock, failing with ErrLocked if block is false and it's held
+func lockFile(file *os.File, block bool) error {
+    how := syscall.LOCK_EX
+    if !block {
+        how |= syscall.LOCK_NB
+    }
+
+    for {
+        err := syscall.Flock(int(file.Fd()), how)
+        if err == syscall.EINTR {
+            continue
+        }
+        if err == syscall.EWOULDBLOCK {
+            return ErrLocked
+        }
+        return err
+    }
+}
+
+// unlockFile releases the flock
+func unlockFile(file *os.File) error {
+    return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
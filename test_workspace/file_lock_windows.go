@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+    "os"
+
+    "golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive LockFileEx lock, failing with ErrLocked if block is false and it's held
+func lockFile(file *os.File, block bool) error {
+    flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK)
+    if !block {
+        flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+    }
+
+    overlapped := new(windows.Overlapped)
+    err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, overlapped)
+    if err == windows.ERROR_LOCK_VIOLATION {
+        return ErrLocked
+    }
+    return err
+}
+
+// unlockFile releases the LockFileEx lock
+func unlockFile(file *os.File) error {
+    overlapped := new(windows.Overlapped)
+    return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+}
@@ -1,28 +1,484 @@
 package main
 
 import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "hash"
+    "io"
+    "io/fs"
     "io/ioutil"
     "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/unicode"
+    "golang.org/x/text/transform"
 )
 
 // ReadFileContent reads entire file and returns content
 func ReadFileContent(filepath string) (string, error) {
-    content, err := ioutil.ReadFile(filepath)
+    file, err := os.Open(filepath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    return ReadAll(file)
+}
+
+// ReadAll reads everything from r, e.g. os.Stdin or an in-memory buffer
+func ReadAll(r io.Reader) (string, error) {
+    content, err := ioutil.ReadAll(r)
     if err != nil {
         return "", err
     }
     return string(content), nil
 }
 
+// ReadFileWithEncoding reads a file stored in enc, e.g. charmap.Windows1252 or
+// japanese.ShiftJIS, and returns its content as UTF-8. Bytes that aren't valid in enc
+// become U+FFFD rather than failing the read.
+func ReadFileWithEncoding(filepath string, enc encoding.Encoding) (string, error) {
+    file, err := os.Open(filepath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    return ReadAll(transform.NewReader(file, enc.NewDecoder()))
+}
+
+// ReadFileDetectEncoding is ReadFileWithEncoding that honors a UTF-8 or UTF-16 byte
+// order mark, stripping it from the result. Files without a BOM are decoded with
+// fallback, or as UTF-8 if fallback is nil.
+func ReadFileDetectEncoding(filepath string, fallback encoding.Encoding) (string, error) {
+    if fallback == nil {
+        fallback = unicode.UTF8
+    }
+    file, err := os.Open(filepath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    return ReadAll(transform.NewReader(file, unicode.BOMOverride(fallback.NewDecoder())))
+}
+
+// ReadFileLines streams a file line by line, calling fn for each line.
+// It stops at the first error returned by fn.
+func ReadFileLines(filepath string, fn func(line string) error) error {
+    return ReadFileLinesWithLimit(filepath, bufio.MaxScanTokenSize, fn)
+}
+
+// ReadLines returns every line in the file with \n or \r\n endings stripped.
+// A trailing newline ends the last line rather than starting an empty one, so
+// "a\nb\n" and "a\nb" both give ["a" "b"]; an empty file gives no lines.
+func ReadLines(filepath string) ([]string, error) {
+    var lines []string
+    err := ReadFileLines(filepath, func(line string) error {
+        lines = append(lines, line)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return lines, nil
+}
+
+// ReadFileLinesWithLimit is ReadFileLines with a custom maximum line length in bytes.
+// Lines longer than maxLineLength, not counting the line ending, fail with
+// bufio.ErrTooLong; a negative maxLineLength is an error.
+func ReadFileLinesWithLimit(filepath string, maxLineLength int, fn func(line string) error) error {
+    if maxLineLength < 0 {
+        return fmt.Errorf("invalid max line length %d", maxLineLength)
+    }
+    file, err := os.Open(filepath)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    // The buffer also has to hold the "\r\n" the scanner strips
+    bufferSize := maxLineLength + 2
+    scanner := bufio.NewScanner(file)
+    initial := bufio.MaxScanTokenSize
+    if bufferSize < initial {
+        initial = bufferSize
+    }
+    scanner.Buffer(make([]byte, 0, initial), bufferSize)
+
+    for scanner.Scan() {
+        if len(scanner.Bytes()) > maxLineLength {
+            return bufio.ErrTooLong
+        }
+        if err := fn(scanner.Text()); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// ReadFileChunk reads up to length bytes starting at offset. A range that runs
+// past the end of the file returns the bytes available without an error.
+func ReadFileChunk(filepath string, offset, length int64) ([]byte, error) {
+    if offset < 0 || length < 0 {
+        return nil, fmt.Errorf("invalid chunk range: offset %d, length %d", offset, length)
+    }
+
+    file, err := os.Open(filepath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    // Don't allocate more than the file can supply
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if remaining := info.Size() - offset; remaining < length {
+        length = remaining
+    }
+    if length <= 0 {
+        return []byte{}, nil
+    }
+
+    buf := make([]byte, length)
+    n, err := file.ReadAt(buf, offset)
+    if err != nil && err != io.EOF {
+        return nil, err
+    }
+    return buf[:n], nil
+}
+
+// reverseChunkSize is how much ReadLastNLines reads per step back from the end
+const reverseChunkSize = 4096
+
+// ReadLastNLines returns the last n lines of a file, oldest first, like tail -n.
+// It reads backwards from the end in chunks, so only the tail is loaded. Line
+// endings are stripped as in ReadLines; a file with fewer than n lines is
+// returned whole.
+func ReadLastNLines(filepath string, n int) ([]string, error) {
+    if n <= 0 {
+        return nil, nil
+    }
+
+    file, err := os.Open(filepath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if info.Size() == 0 {
+        return nil, nil
+    }
+
+    var chunks [][]byte
+    newlines := 0
+    offset := info.Size()
+    trailing := true
+    for offset > 0 && newlines <= n {
+        size := int64(reverseChunkSize)
+        if offset < size {
+            size = offset
+        }
+        offset -= size
+
+        chunk := make([]byte, size)
+        if _, err := file.ReadAt(chunk, offset); err != nil {
+            return nil, err
+        }
+        if trailing {
+            // The newline ending the last line doesn't start another one
+            chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+            trailing = false
+        }
+        newlines += bytes.Count(chunk, []byte("\n"))
+        chunks = append(chunks, chunk)
+    }
+
+    for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+        chunks[i], chunks[j] = chunks[j], chunks[i]
+    }
+    data := bytes.Join(chunks, nil)
+
+    lines := strings.Split(string(data), "\n")
+    if len(lines) > n {
+        lines = lines[len(lines)-n:]
+    }
+    for i, line := range lines {
+        lines[i] = strings.TrimSuffix(line, "\r")
+    }
+    return lines, nil
+}
+
+// tailPollInterval is how often TailFile checks for new content
+const tailPollInterval = 250 * time.Millisecond
+
+// TailFile calls fn for every line already in the file and then for each line
+// appended afterwards, until ctx is cancelled. If the file is truncated it is
+// re-read from the start; if it is replaced (log rotation) the new file is followed.
+func TailFile(ctx context.Context, filepath string, fn func(line string)) error {
+    file, err := os.Open(filepath)
+    if err != nil {
+        return err
+    }
+    defer func() { file.Close() }()
+
+    current, err := file.Stat()
+    if err != nil {
+        return err
+    }
+
+    reader := bufio.NewReader(file)
+    var partial string
+    ticker := time.NewTicker(tailPollInterval)
+    defer ticker.Stop()
+
+    for {
+        chunk, err := reader.ReadString('\n')
+        if strings.HasSuffix(chunk, "\n") {
+            fn(strings.TrimRight(partial+chunk, "\r\n"))
+            partial = ""
+        } else {
+            // Hold an incomplete last line until the writer finishes it
+            partial += chunk
+        }
+        if err == nil {
+            continue
+        }
+        if err != io.EOF {
+            return err
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+
+        if latest, err := os.Stat(filepath); err == nil && !os.SameFile(current, latest) {
+            rotated, err := os.Open(filepath)
+            if err != nil {
+                continue // the new file may not be fully in place yet
+            }
+            info, err := rotated.Stat()
+            if err != nil {
+                rotated.Close()
+                continue
+            }
+            file.Close()
+            file, current = rotated, info
+            reader.Reset(file)
+            partial = ""
+            continue
+        }
+
+        offset, err := file.Seek(0, io.SeekCurrent)
+        if err != nil {
+            return err
+        }
+        if info, err := file.Stat(); err == nil && info.Size() < offset {
+            if _, err := file.Seek(0, io.SeekStart); err != nil {
+                return err
+            }
+            reader.Reset(file)
+            partial = ""
+        }
+    }
+}
+
+// CountLines counts the lines in a file without loading it into memory.
+// A final line without a trailing newline still counts, so "a\nb" is 2 lines
+// and an empty file is 0.
+func CountLines(filepath string) (int64, error) {
+    file, err := os.Open(filepath)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+
+    var count int64
+    var last byte = '\n'
+    buf := make([]byte, 64*1024)
+    for {
+        n, err := file.Read(buf)
+        if n > 0 {
+            count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+            last = buf[n-1]
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    if last != '\n' {
+        count++
+    }
+    return count, nil
+}
+
+// Match is a regular expression match found by SearchInFile
+type Match struct {
+    Line   int    // 1-based line number
+    Column int    // 1-based byte offset within the line
+    Text   string // the matched text
+}
+
+// SearchOptions controls SearchInFileWithOptions
+type SearchOptions struct {
+    // CaseInsensitive matches regardless of letter case
+    CaseInsensitive bool
+    // FirstOnly stops after the first match in the file
+    FirstOnly bool
+}
+
+// errStopSearch ends a search early once FirstOnly has its match
+var errStopSearch = errors.New("stop search")
+
+// SearchInFile returns every match of pattern, streaming the file line by line
+func SearchInFile(filepath string, pattern *regexp.Regexp) ([]Match, error) {
+    return SearchInFileWithOptions(filepath, pattern, SearchOptions{})
+}
+
+// SearchInFileWithOptions is SearchInFile with case-insensitivity and early exit
+func SearchInFileWithOptions(filepath string, pattern *regexp.Regexp, opts SearchOptions) ([]Match, error) {
+    if opts.CaseInsensitive {
+        var err error
+        pattern, err = regexp.Compile("(?i)" + pattern.String())
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    var matches []Match
+    lineNumber := 0
+    err := ReadFileLines(filepath, func(line string) error {
+        lineNumber++
+        for _, loc := range pattern.FindAllStringIndex(line, -1) {
+            matches = append(matches, Match{
+                Line:   lineNumber,
+                Column: loc[0] + 1,
+                Text:   line[loc[0]:loc[1]],
+            })
+            if opts.FirstOnly {
+                return errStopSearch
+            }
+        }
+        return nil
+    })
+    if err != nil && err != errStopSearch {
+        return nil, err
+    }
+    return matches, nil
+}
+
 // WriteToFile writes data to a file
 func WriteToFile(filepath string, data string) error {
-    return ioutil.WriteFile(filepath, []byte(data), 0644)
+    return WriteToFileMode(filepath, data, 0644)
+}
+
+// WriteToFileMode writes data to a file, creating it with perm. As with
+// os.OpenFile, perm is reduced by the process umask and is ignored if the file
+// already exists; use SetPermissions to change an existing file's mode.
+func WriteToFileMode(filepath string, data string, perm os.FileMode) error {
+    return WriteBytesToFile(filepath, []byte(data), perm)
+}
+
+// WriteBytesToFile is WriteToFileMode for data that is already a byte slice
+func WriteBytesToFile(filepath string, data []byte, perm os.FileMode) error {
+    return ioutil.WriteFile(filepath, data, perm)
 }
 
-// AppendToFile adds content to end of file
+// WriteReaderToFile streams r into a file, creating it with perm or truncating it,
+// without holding the whole payload in memory. A failed copy leaves whatever was
+// written so far in place.
+func WriteReaderToFile(filepath string, r io.Reader, perm os.FileMode) error {
+    out, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+
+    if _, err := io.Copy(out, r); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// WriteToFileWithDirs is WriteToFile that first creates any missing parent directories
+func WriteToFileWithDirs(filepath string, data string) error {
+    if err := EnsureDir(parentDir(filepath), 0755); err != nil {
+        return err
+    }
+    return WriteToFile(filepath, data)
+}
+
+// WriteFileAtomic writes data to a temp file in the target's directory, fsyncs it,
+// and renames it into place so readers never observe a partially written file.
+// A file being replaced keeps its permissions; a new one gets 0644.
+func WriteFileAtomic(path string, data string) (err error) {
+    perm := os.FileMode(0644)
+    if info, statErr := os.Stat(path); statErr == nil {
+        perm = info.Mode().Perm()
+    }
+
+    tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpName := tmp.Name()
+    defer func() {
+        if err != nil {
+            tmp.Close()
+            os.Remove(tmpName)
+        }
+    }()
+
+    if _, err = tmp.WriteString(data); err != nil {
+        return err
+    }
+    if err = tmp.Chmod(perm); err != nil {
+        return err
+    }
+    if err = tmp.Sync(); err != nil {
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmpName, path)
+}
+
+// AppendToFile adds content to end of file, creating it if needed
 func AppendToFile(filepath string, content string) error {
-    file, err := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0644)
+    return AppendToFileMode(filepath, content, 0644)
+}
+
+// AppendToFileMode is AppendToFile creating a missing file with perm (subject to
+// umask); an existing file keeps its mode
+func AppendToFileMode(filepath string, content string, perm os.FileMode) error {
+    file, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
     if err != nil {
         return err
     }
@@ -32,6 +488,300 @@ func AppendToFile(filepath string, content string) error {
     return err
 }
 
+// TruncateOpts controls TruncateFileWithOpts behavior
+type TruncateOpts struct {
+    // Create makes a missing file, with mode 0644 before umask, instead of failing
+    Create bool
+}
+
+// TruncateFile cuts path to size bytes in place, or extends it with zeros; size 0
+// empties it. The file is not replaced, so other processes holding it open, such
+// as a logger, keep writing to it. A missing file fails with *NotExistError.
+func TruncateFile(path string, size int64) error {
+    return TruncateFileWithOpts(path, size, TruncateOpts{})
+}
+
+// TruncateFileWithOpts is TruncateFile with options
+func TruncateFileWithOpts(path string, size int64, opts TruncateOpts) error {
+    if size < 0 {
+        return fmt.Errorf("truncating %s: negative size %d", path, size)
+    }
+
+    if opts.Create {
+        file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+        if err != nil {
+            return err
+        }
+        if err := file.Truncate(size); err != nil {
+            file.Close()
+            return err
+        }
+        return file.Close()
+    }
+
+    if err := os.Truncate(path, size); err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return &NotExistError{Path: path}
+        }
+        return err
+    }
+    return nil
+}
+
+// SetPermissions sets the mode of an existing file; unlike creation modes it is not masked by umask
+func SetPermissions(path string, perm os.FileMode) error {
+    return os.Chmod(path, perm)
+}
+
+// CopyFileOpts controls CopyFileWithOpts behavior
+type CopyFileOpts struct {
+    // Overwrite replaces dst if it already exists
+    Overwrite bool
+}
+
+// CopyFile streams src to dst, preserving permission bits. It fails if dst exists.
+func CopyFile(src, dst string) error {
+    return CopyFileWithOpts(src, dst, CopyFileOpts{})
+}
+
+// CopyFileWithOpts streams src to dst, preserving permission bits
+func CopyFileWithOpts(src, dst string, opts CopyFileOpts) error {
+    srcInfo, err := os.Stat(src)
+    if err != nil {
+        return fmt.Errorf("copy source: %w", err)
+    }
+    if !srcInfo.Mode().IsRegular() {
+        return fmt.Errorf("copy source %s is not a regular file", src)
+    }
+
+    if dstInfo, err := os.Stat(dst); err == nil {
+        if os.SameFile(srcInfo, dstInfo) {
+            return fmt.Errorf("copy source and destination are the same file: %s", src)
+        }
+        if !opts.Overwrite {
+            return fmt.Errorf("copy destination %s already exists", dst)
+        }
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+    if !opts.Overwrite {
+        flags |= os.O_EXCL
+    }
+    out, err := os.OpenFile(dst, flags, srcInfo.Mode().Perm())
+    if err != nil {
+        return err
+    }
+
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+    return os.Chmod(dst, srcInfo.Mode().Perm())
+}
+
+// CopyDirOpts controls CopyDirWithOpts behavior
+type CopyDirOpts struct {
+    // FollowSymlinks copies what symlinks point to instead of recreating the links.
+    // A link back to a directory being copied fails the copy rather than looping.
+    FollowSymlinks bool
+    // Overwrite merges into an existing dst, replacing files that already exist
+    Overwrite bool
+}
+
+// CopyDir recursively copies the directory src to dst, preserving permission bits
+// and recreating symlinks as links. It fails if dst exists.
+func CopyDir(src, dst string) error {
+    return CopyDirWithOpts(src, dst, CopyDirOpts{})
+}
+
+// CopyDirWithOpts recursively copies the directory src to dst
+func CopyDirWithOpts(src, dst string, opts CopyDirOpts) error {
+    srcInfo, err := os.Stat(src)
+    if err != nil {
+        return fmt.Errorf("copy source: %w", err)
+    }
+    if !srcInfo.IsDir() {
+        return fmt.Errorf("copy source %s is not a directory", src)
+    }
+    if _, err := os.Lstat(dst); err == nil && !opts.Overwrite {
+        return fmt.Errorf("copy destination %s already exists", dst)
+    } else if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+
+    absSrc, err := filepath.Abs(src)
+    if err != nil {
+        return err
+    }
+    absDst, err := filepath.Abs(dst)
+    if err != nil {
+        return err
+    }
+    if absDst == absSrc || strings.HasPrefix(absDst, absSrc+string(filepath.Separator)) {
+        return fmt.Errorf("cannot copy %s into itself", src)
+    }
+
+    return copyTree(src, dst, srcInfo, opts, map[string]bool{})
+}
+
+// copyTree copies the directory src, described by info, to dst. visiting holds the
+// real paths of the directories being copied, to catch symlink cycles.
+func copyTree(src, dst string, info os.FileInfo, opts CopyDirOpts, visiting map[string]bool) error {
+    real, err := filepath.EvalSymlinks(src)
+    if err != nil {
+        return err
+    }
+    if visiting[real] {
+        return fmt.Errorf("symlink cycle at %s", src)
+    }
+    visiting[real] = true
+    defer delete(visiting, real)
+
+    // Create owner-writable so read-only directories can still be filled
+    if err := os.MkdirAll(dst, 0700); err != nil {
+        return err
+    }
+
+    entries, err := os.ReadDir(src)
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        srcPath := filepath.Join(src, entry.Name())
+        dstPath := filepath.Join(dst, entry.Name())
+
+        entryInfo, err := os.Lstat(srcPath)
+        if err != nil {
+            return err
+        }
+        if entryInfo.Mode()&os.ModeSymlink != 0 {
+            if !opts.FollowSymlinks {
+                if err := copySymlink(srcPath, dstPath, opts.Overwrite); err != nil {
+                    return err
+                }
+                continue
+            }
+            if entryInfo, err = os.Stat(srcPath); err != nil {
+                return fmt.Errorf("following symlink %s: %w", srcPath, err)
+            }
+        }
+
+        switch {
+        case entryInfo.IsDir():
+            err = copyTree(srcPath, dstPath, entryInfo, opts, visiting)
+        case entryInfo.Mode().IsRegular():
+            err = CopyFileWithOpts(srcPath, dstPath, CopyFileOpts{Overwrite: opts.Overwrite})
+        default:
+            err = fmt.Errorf("cannot copy %s: unsupported file type %s", srcPath, entryInfo.Mode().Type())
+        }
+        if err != nil {
+            return err
+        }
+    }
+
+    return os.Chmod(dst, info.Mode().Perm())
+}
+
+// copySymlink recreates the symlink src at dst with the same target
+func copySymlink(src, dst string, overwrite bool) error {
+    target, err := os.Readlink(src)
+    if err != nil {
+        return err
+    }
+    if overwrite {
+        if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return os.Symlink(target, dst)
+}
+
+// MoveDir renames the directory src to dst, falling back to a recursive copy and
+// removal of src when they are on different filesystems
+func MoveDir(src, dst string) error {
+    err := os.Rename(src, dst)
+    if err == nil {
+        return nil
+    }
+    if !isCrossDevice(err) {
+        return err
+    }
+
+    if err := CopyDir(src, dst); err != nil {
+        return fmt.Errorf("moving across filesystems: %w", err)
+    }
+    return os.RemoveAll(src)
+}
+
+// DeleteFileOpts controls DeleteFileWithOpts behavior
+type DeleteFileOpts struct {
+    // IgnoreMissing makes deleting a path that doesn't exist a no-op
+    IgnoreMissing bool
+}
+
+// DeleteFile removes a file; it fails if the file doesn't exist
+func DeleteFile(path string) error {
+    return DeleteFileWithOpts(path, DeleteFileOpts{})
+}
+
+// DeleteFileWithOpts removes a file
+func DeleteFileWithOpts(path string, opts DeleteFileOpts) error {
+    info, err := os.Lstat(path)
+    if err != nil {
+        if os.IsNotExist(err) && opts.IgnoreMissing {
+            return nil
+        }
+        return err
+    }
+    if info.IsDir() {
+        return fmt.Errorf("%s is a directory; use RemoveDir", path)
+    }
+    return os.Remove(path)
+}
+
+// RemoveDir removes a directory. Without recursive it only removes an empty directory.
+func RemoveDir(path string, recursive bool) error {
+    info, err := os.Lstat(path)
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return fmt.Errorf("%s is not a directory", path)
+    }
+    if recursive {
+        return os.RemoveAll(path)
+    }
+    return os.Remove(path)
+}
+
+// MoveFile renames src to dst, falling back to copy and delete when they are
+// on different filesystems
+func MoveFile(src, dst string) error {
+    err := os.Rename(src, dst)
+    if err == nil {
+        return nil
+    }
+    if !isCrossDevice(err) {
+        return err
+    }
+
+    if err := CopyFileWithOpts(src, dst, CopyFileOpts{Overwrite: true}); err != nil {
+        return fmt.Errorf("moving across filesystems: %w", err)
+    }
+    return os.Remove(src)
+}
+
 // GetFileSize returns the size of a file in bytes
 func GetFileSize(filepath string) (int64, error) {
     info, err := os.Stat(filepath)
@@ -40,3 +790,680 @@ func GetFileSize(filepath string) (int64, error) {
     }
     return info.Size(), nil
 }
+
+// FileMeta is the metadata StatFile reports for a single path
+type FileMeta struct {
+    Path    string
+    Size    int64
+    ModTime time.Time
+    Mode    os.FileMode
+    IsDir   bool
+}
+
+// NotExistError reports that a path StatFile or IsNewer looked at does not exist.
+// errors.Is(err, fs.ErrNotExist) also matches it.
+type NotExistError struct {
+    Path string
+}
+
+// Error implements error
+func (e *NotExistError) Error() string {
+    return e.Path + ": file does not exist"
+}
+
+// Is makes NotExistError match fs.ErrNotExist
+func (e *NotExistError) Is(target error) bool {
+    return target == fs.ErrNotExist
+}
+
+// StatFile returns size, modification time, mode and directory flag for path,
+// following symlinks. A missing path fails with *NotExistError.
+func StatFile(path string) (*FileMeta, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return nil, &NotExistError{Path: path}
+        }
+        return nil, err
+    }
+    return &FileMeta{
+        Path:    path,
+        Size:    info.Size(),
+        ModTime: info.ModTime(),
+        Mode:    info.Mode(),
+        IsDir:   info.IsDir(),
+    }, nil
+}
+
+// IsNewer reports whether a was modified more recently than b, as in a build
+// checking whether an output is out of date. Either path missing is a *NotExistError.
+func IsNewer(a, b string) (bool, error) {
+    metaA, err := StatFile(a)
+    if err != nil {
+        return false, err
+    }
+    metaB, err := StatFile(b)
+    if err != nil {
+        return false, err
+    }
+    return metaA.ModTime.After(metaB.ModTime), nil
+}
+
+// PathExists reports whether path exists. A missing path is (false, nil);
+// other failures such as permission errors are returned.
+func PathExists(path string) (bool, error) {
+    _, err := os.Stat(path)
+    if err == nil {
+        return true, nil
+    }
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    return false, fmt.Errorf("checking %s: %w", path, err)
+}
+
+// IsDir reports whether path exists and is a directory
+func IsDir(path string) (bool, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return false, nil
+        }
+        return false, fmt.Errorf("checking %s: %w", path, err)
+    }
+    return info.IsDir(), nil
+}
+
+// EnsureDir creates path and any missing parents with perm
+func EnsureDir(path string, perm os.FileMode) error {
+    info, err := os.Stat(path)
+    if err == nil {
+        if !info.IsDir() {
+            return fmt.Errorf("%s exists and is not a directory", path)
+        }
+        return nil
+    }
+    if !os.IsNotExist(err) {
+        return fmt.Errorf("checking %s: %w", path, err)
+    }
+    return os.MkdirAll(path, perm)
+}
+
+// parentDir returns the directory containing path, for helpers whose
+// filepath parameter shadows the package
+func parentDir(path string) string {
+    return filepath.Dir(path)
+}
+
+// FileInfo describes a directory entry
+type FileInfo struct {
+    Name    string
+    Path    string
+    Size    int64
+    ModTime time.Time
+    IsDir   bool
+}
+
+// ListOptions filters ListDirWithOptions and WalkDirWithOptions results
+type ListOptions struct {
+    // SkipHidden omits entries whose name starts with "."; hidden directories are not descended into
+    SkipHidden bool
+    // Pattern, if set, is a filepath.Match glob that entry names must match.
+    // Directories that don't match are still descended into by WalkDir.
+    Pattern string
+}
+
+// ListDir returns metadata for each entry directly inside path
+func ListDir(path string) ([]FileInfo, error) {
+    return ListDirWithOptions(path, ListOptions{})
+}
+
+// ListDirWithOptions returns metadata for the entries inside path that pass opts
+func ListDirWithOptions(path string, opts ListOptions) ([]FileInfo, error) {
+    entries, err := os.ReadDir(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var infos []FileInfo
+    for _, entry := range entries {
+        include, err := opts.includes(entry.Name())
+        if err != nil {
+            return nil, err
+        }
+        if !include {
+            continue
+        }
+
+        info, err := entry.Info()
+        if err != nil {
+            return nil, err
+        }
+        infos = append(infos, newFileInfo(filepath.Join(path, entry.Name()), info))
+    }
+    return infos, nil
+}
+
+// WalkDir calls fn for every file and directory under root, including root itself
+func WalkDir(root string, fn func(path string, info FileInfo) error) error {
+    return WalkDirWithOptions(root, ListOptions{}, fn)
+}
+
+// WalkDirWithOptions is WalkDir restricted to entries that pass opts
+func WalkDirWithOptions(root string, opts ListOptions, fn func(path string, info FileInfo) error) error {
+    return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+
+        if path != root && opts.SkipHidden && isHidden(entry.Name()) {
+            if entry.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        include, err := opts.includes(entry.Name())
+        if err != nil {
+            return err
+        }
+        if !include {
+            return nil
+        }
+
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        return fn(path, newFileInfo(path, info))
+    })
+}
+
+// FindFiles returns the files under root whose slash-separated path relative to root
+// matches pattern, in lexical order. Each path segment is matched with path.Match,
+// and a "**" segment matches any number of directories, so "**/*.go" finds Go files
+// at any depth and "cmd/**/main.go" any main.go below cmd. With recursive set, a
+// pattern without "**" matches at any depth, as if prefixed with "**/".
+// Directories themselves are never returned.
+func FindFiles(root, pattern string, recursive bool) ([]string, error) {
+    segments := strings.Split(pattern, "/")
+    for _, segment := range segments {
+        if _, err := path.Match(segment, ""); err != nil {
+            return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+        }
+    }
+
+    deep := false
+    for _, segment := range segments {
+        if segment == "**" {
+            deep = true
+        }
+    }
+    if recursive && !deep {
+        segments = append([]string{"**"}, segments...)
+        deep = true
+    }
+
+    var matches []string
+    err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(root, p)
+        if err != nil {
+            return err
+        }
+        if rel == "." {
+            return nil
+        }
+        relSegments := strings.Split(filepath.ToSlash(rel), "/")
+
+        if entry.IsDir() {
+            // Without "**" nothing deeper than the pattern can match
+            if !deep && len(relSegments) >= len(segments) {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if matchSegments(segments, relSegments) {
+            matches = append(matches, p)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return matches, nil
+}
+
+// matchSegments matches path segments against glob segments, where "**" matches
+// zero or more whole segments
+func matchSegments(pattern, segments []string) bool {
+    for len(pattern) > 0 {
+        if pattern[0] == "**" {
+            for i := 0; i <= len(segments); i++ {
+                if matchSegments(pattern[1:], segments[i:]) {
+                    return true
+                }
+            }
+            return false
+        }
+        if len(segments) == 0 {
+            return false
+        }
+        if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+            return false
+        }
+        pattern, segments = pattern[1:], segments[1:]
+    }
+    return len(segments) == 0
+}
+
+// includes reports whether an entry called name passes the filters
+func (opts ListOptions) includes(name string) (bool, error) {
+    if opts.SkipHidden && isHidden(name) {
+        return false, nil
+    }
+    if opts.Pattern == "" {
+        return true, nil
+    }
+    matched, err := filepath.Match(opts.Pattern, name)
+    if err != nil {
+        return false, fmt.Errorf("invalid pattern %q: %w", opts.Pattern, err)
+    }
+    return matched, nil
+}
+
+// isHidden reports whether a file name is hidden by Unix convention
+func isHidden(name string) bool {
+    return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// newFileInfo converts an os.FileInfo into a FileInfo
+func newFileInfo(path string, info os.FileInfo) FileInfo {
+    return FileInfo{
+        Name:    info.Name(),
+        Path:    path,
+        Size:    info.Size(),
+        ModTime: info.ModTime(),
+        IsDir:   info.IsDir(),
+    }
+}
+
+// GzipOpts controls GzipFileWithOpts behavior
+type GzipOpts struct {
+    // RemoveSource deletes src once it has been compressed successfully
+    RemoveSource bool
+}
+
+// GzipFile compresses src into dst, leaving src in place
+func GzipFile(src, dst string) error {
+    return GzipFileWithOpts(src, dst, GzipOpts{})
+}
+
+// GzipFileWithOpts streams src through gzip into dst. dst must not be src itself,
+// which would be truncated before it is read.
+func GzipFileWithOpts(src, dst string, opts GzipOpts) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    if srcInfo, err := in.Stat(); err == nil {
+        if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+            return fmt.Errorf("gzip source and destination are the same file: %s", src)
+        }
+    }
+
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    gz := gzip.NewWriter(out)
+    if _, err := io.Copy(gz, in); err != nil {
+        out.Close()
+        return err
+    }
+    if err := gz.Close(); err != nil {
+        out.Close()
+        return err
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+
+    if opts.RemoveSource {
+        in.Close()
+        return os.Remove(src)
+    }
+    return nil
+}
+
+// GunzipFile decompresses the gzip file src into dst
+func GunzipFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    gz, err := gzip.NewReader(in)
+    if err != nil {
+        return fmt.Errorf("reading gzip header of %s: %w", src, err)
+    }
+    defer gz.Close()
+
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, gz); err != nil {
+        out.Close()
+        return fmt.Errorf("decompressing %s: %w", src, err)
+    }
+    return out.Close()
+}
+
+// ReadGzipFile is ReadFileContent that transparently decompresses gzip data,
+// detected by its magic bytes rather than the file extension
+func ReadGzipFile(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    reader := bufio.NewReader(file)
+    magic, err := reader.Peek(2)
+    if err != nil && err != io.EOF {
+        return "", err
+    }
+
+    var src io.Reader = reader
+    if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+        gz, err := gzip.NewReader(reader)
+        if err != nil {
+            return "", fmt.Errorf("reading gzip header of %s: %w", path, err)
+        }
+        defer gz.Close()
+        src = gz
+    }
+
+    return ReadAll(src)
+}
+
+// CSVOptions configures the CSV helpers
+type CSVOptions struct {
+    // Comma is the field delimiter, e.g. ',', '\t' or ';'. Zero means ','.
+    Comma rune
+    // HasHeader treats the first row as column names rather than data when reading
+    HasHeader bool
+}
+
+// ReadCSV reads every comma-separated record in a file
+func ReadCSV(filepath string) ([][]string, error) {
+    _, records, err := ReadCSVWithOptions(filepath, CSVOptions{})
+    return records, err
+}
+
+// ReadCSVWithOptions reads every record in a file; header is nil unless opts.HasHeader
+func ReadCSVWithOptions(filepath string, opts CSVOptions) (header []string, records [][]string, err error) {
+    err = ReadCSVRowsWithOptions(filepath, opts, func(h, row []string) error {
+        header = h
+        records = append(records, row)
+        return nil
+    })
+    return header, records, err
+}
+
+// ReadCSVRows streams comma-separated records to fn one at a time
+func ReadCSVRows(filepath string, fn func(row []string) error) error {
+    return ReadCSVRowsWithOptions(filepath, CSVOptions{}, func(_, row []string) error {
+        return fn(row)
+    })
+}
+
+// ReadCSVRowsWithOptions streams records to fn without loading the whole file.
+// header is nil unless opts.HasHeader; reading stops at the first error from fn.
+func ReadCSVRowsWithOptions(filepath string, opts CSVOptions, fn func(header, row []string) error) error {
+    file, err := os.Open(filepath)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    reader := csv.NewReader(bufio.NewReader(file))
+    if opts.Comma != 0 {
+        reader.Comma = opts.Comma
+    }
+
+    var header []string
+    if opts.HasHeader {
+        header, err = reader.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("reading CSV header of %s: %w", filepath, err)
+        }
+    }
+
+    for {
+        row, err := reader.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("reading CSV %s: %w", filepath, err)
+        }
+        if err := fn(header, row); err != nil {
+            return err
+        }
+    }
+}
+
+// WriteCSV writes records to a file as comma-separated values
+func WriteCSV(filepath string, records [][]string) error {
+    return WriteCSVWithOptions(filepath, records, CSVOptions{})
+}
+
+// WriteCSVWithOptions writes records using opts.Comma; a header, if any, is
+// simply the first record
+func WriteCSVWithOptions(filepath string, records [][]string, opts CSVOptions) error {
+    file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    writer := csv.NewWriter(file)
+    if opts.Comma != 0 {
+        writer.Comma = opts.Comma
+    }
+    if err := writer.WriteAll(records); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// ReadJSONFile unmarshals the JSON in a file into v
+func ReadJSONFile(filepath string, v interface{}) error {
+    content, err := ioutil.ReadFile(filepath)
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(content, v); err != nil {
+        return fmt.Errorf("decoding JSON in %s: %w", filepath, err)
+    }
+    return nil
+}
+
+// WriteJSONFile atomically writes v as JSON, pretty-printed when indent is set
+func WriteJSONFile(filepath string, v interface{}, indent bool) error {
+    var data []byte
+    var err error
+    if indent {
+        data, err = json.MarshalIndent(v, "", "  ")
+    } else {
+        data, err = json.Marshal(v)
+    }
+    if err != nil {
+        return fmt.Errorf("encoding JSON for %s: %w", filepath, err)
+    }
+    return WriteFileAtomic(filepath, string(append(data, '\n')))
+}
+
+// ErrLocked is returned by TryLockFile when another process holds the lock
+var ErrLocked = errors.New("file is locked")
+
+// FileLock is an advisory, exclusive lock on a file held by this process
+type FileLock struct {
+    path string
+    file *os.File
+}
+
+// LockFile blocks until it holds an exclusive advisory lock on path, creating it if needed
+func LockFile(path string) (*FileLock, error) {
+    return acquireFileLock(path, true)
+}
+
+// TryLockFile takes the lock only if it is free, returning ErrLocked otherwise
+func TryLockFile(path string) (*FileLock, error) {
+    return acquireFileLock(path, false)
+}
+
+// acquireFileLock opens path and locks it with the platform's advisory lock
+func acquireFileLock(path string, block bool) (*FileLock, error) {
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    if err := lockFile(file, block); err != nil {
+        file.Close()
+        return nil, err
+    }
+    return &FileLock{path: path, file: file}, nil
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+    if err := unlockFile(l.file); err != nil {
+        l.file.Close()
+        return fmt.Errorf("unlocking %s: %w", l.path, err)
+    }
+    return l.file.Close()
+}
+
+// WithFileLock runs fn while holding the lock on path
+func WithFileLock(path string, fn func() error) (err error) {
+    lock, err := LockFile(path)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        if unlockErr := lock.Unlock(); err == nil {
+            err = unlockErr
+        }
+    }()
+    return fn()
+}
+
+// TempFileHandle is a temporary file that removes itself on Cleanup
+type TempFileHandle struct {
+    Path string
+    file *os.File
+}
+
+// TempFile creates a temp file in dir (the system temp dir if empty); pattern
+// follows ioutil.TempFile, so a "*" is replaced by a random string
+func TempFile(dir, pattern string) (*TempFileHandle, error) {
+    file, err := ioutil.TempFile(dir, pattern)
+    if err != nil {
+        return nil, err
+    }
+    return &TempFileHandle{Path: file.Name(), file: file}, nil
+}
+
+// Write implements io.Writer
+func (t *TempFileHandle) Write(p []byte) (int, error) {
+    return t.file.Write(p)
+}
+
+// Close flushes the file to disk without removing it
+func (t *TempFileHandle) Close() error {
+    return t.file.Close()
+}
+
+// Cleanup closes and removes the file; it is safe to call more than once
+func (t *TempFileHandle) Cleanup() error {
+    t.file.Close()
+    if err := os.Remove(t.Path); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// WithTempFile runs fn with the path of a fresh, closed temp file and removes
+// the file afterwards, even if fn panics
+func WithTempFile(fn func(path string) error) error {
+    tmp, err := TempFile("", "tmp-*")
+    if err != nil {
+        return err
+    }
+    defer tmp.Cleanup()
+
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return fn(tmp.Path)
+}
+
+// HashAlgo selects the digest used by FileChecksum
+type HashAlgo int
+
+const (
+    SHA256 HashAlgo = iota
+    MD5
+)
+
+// newHash returns a fresh hash.Hash for the algorithm
+func (a HashAlgo) newHash() (hash.Hash, error) {
+    switch a {
+    case SHA256:
+        return sha256.New(), nil
+    case MD5:
+        return md5.New(), nil
+    default:
+        return nil, fmt.Errorf("unsupported hash algorithm %d", a)
+    }
+}
+
+// FileChecksum streams a file through the hash and returns its lowercase hex digest
+func FileChecksum(filepath string, algo HashAlgo) (string, error) {
+    h, err := algo.newHash()
+    if err != nil {
+        return "", err
+    }
+
+    file, err := os.Open(filepath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    if _, err := io.Copy(h, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum reports whether the file's digest matches expected (case-insensitive hex)
+func VerifyChecksum(filepath, expected string, algo HashAlgo) (bool, error) {
+    actual, err := FileChecksum(filepath, algo)
+    if err != nil {
+        return false, err
+    }
+    return strings.EqualFold(actual, strings.TrimSpace(expected)), nil
+}
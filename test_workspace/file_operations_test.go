@@ -0,0 +1,37 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+)
+
+func TestAppendToFileCreatesMissingFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "new.log")
+
+    if err := AppendToFile(path, "first line\n"); err != nil {
+        t.Fatalf("AppendToFile: %v", err)
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatalf("reading appended file: %v", err)
+    }
+    if string(data) != "first line\n" {
+        t.Errorf("content = %q, want %q", data, "first line\n")
+    }
+
+    // Windows only tracks a read-only bit
+    if runtime.GOOS == "windows" {
+        return
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatalf("stat: %v", err)
+    }
+    if perm := info.Mode().Perm(); perm != 0644 {
+        t.Errorf("mode = %v, want %v", perm, os.FileMode(0644))
+    }
+}
@@ -0,0 +1,14 @@
+//go:build !plan9
+
+package main
+
+import (
+    "errors"
+    "syscall"
+)
+
+// isCrossDevice reports whether a failed os.Rename needs a copy instead, because
+// source and destination are on different filesystems
+func isCrossDevice(err error) bool {
+    return errors.Is(err, syscall.EXDEV)
+}
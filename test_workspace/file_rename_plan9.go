@@ -0,0 +1,13 @@
+package main
+
+import (
+    "errors"
+    "os"
+)
+
+// isCrossDevice reports whether a failed os.Rename needs a copy instead. Plan 9
+// only renames within a directory, so any rename failure is treated that way.
+func isCrossDevice(err error) bool {
+    var linkErr *os.LinkError
+    return errors.As(err, &linkErr)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long WatchFile waits for a burst of events to settle
+const watchDebounce = 100 * time.Millisecond
+
+// WatchFile calls onChange whenever path is written, created or replaced, until ctx
+// is cancelled. Events arriving within watchDebounce of each other produce a single
+// call. The parent directory is watched rather than the file itself, so editors that
+// save by renaming a new file over the old one keep triggering callbacks.
+// onChange runs on the watching goroutine; a slow callback delays later ones.
+func WatchFile(ctx context.Context, path string, onChange func()) error {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return err
+    }
+    if _, err := os.Stat(abs); err != nil {
+        return err
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("creating watcher: %w", err)
+    }
+    defer watcher.Close()
+
+    if err := watcher.Add(filepath.Dir(abs)); err != nil {
+        return fmt.Errorf("watching %s: %w", filepath.Dir(abs), err)
+    }
+
+    debounce := time.NewTimer(watchDebounce)
+    if !debounce.Stop() {
+        <-debounce.C
+    }
+    defer debounce.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+            if filepath.Clean(event.Name) != abs {
+                continue
+            }
+            if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+                if !debounce.Stop() {
+                    select {
+                    case <-debounce.C:
+                    default:
+                    }
+                }
+                debounce.Reset(watchDebounce)
+            }
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            return fmt.Errorf("watching %s: %w", abs, err)
+        case <-debounce.C:
+            // A rename can leave the path empty until the editor finishes the swap
+            if _, err := os.Stat(abs); err == nil {
+                onChange()
+            }
+        }
+    }
+}
@@ -2,146 +2,3284 @@ package main
 
 import (
     "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
+    "context"
+    cryptorand "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
     "encoding/json"
+    "encoding/xml"
+    "errors"
     "fmt"
+    "io"
     "io/ioutil"
+    "log"
+    "math/rand"
+    "mime"
+    "mime/multipart"
+    "net"
     "net/http"
+    "net/http/cookiejar"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
     "time"
+
+    "github.com/gorilla/websocket"
+    "golang.org/x/net/http2"
+    "golang.org/x/time/rate"
 )
 
 // HTTPClient wraps the standard HTTP client with retry logic
 type HTTPClient struct {
-    client      *http.Client
-    maxRetries  int
-    retryDelay  time.Duration
-    baseURL     string
+    client          *http.Client
+    maxRetries      int
+    retryDelay      time.Duration
+    backoff         BackoffStrategy
+    maxRetryAfter   time.Duration
+    retryStatuses   map[int]bool
+    baseURL         string
+    defaultHeaders  map[string]string
+    breaker         *circuitBreaker
+    limiter         *rate.Limiter
+    limitRetries    bool
+    requestHooks    []RequestHook
+    responseHooks   []ResponseHook
+    tracer          callTracer
+    cache           *responseCache
+    conditional     bool
+    customClient    bool
+    transportConfig []func(*http.Transport)
+    maxRedirects    int
+    jar             http.CookieJar
+    metrics         Metrics
+    idempotencyKeys bool
+    maxResponseSize int64
+    logger          Logger
+    requestTimeout  time.Duration
+    autoDecompress  bool
+    compressAbove   int
+    healthEndpoint  string
+    bufferPool      *sync.Pool
+    errorResponse   func() interface{}
+    signer          func(*http.Request) error
+    retryPredicate  func(*Response, error) bool
+    h2c             bool
+    transport       http.RoundTripper
+    stats           *hostStatsTracker
+    slowThreshold   time.Duration
+    onSlow          func(*http.Request, time.Duration)
+    connectTimeout  time.Duration
+    socketPath      string
+    tlsConfig       *tls.Config
+    breakerWindow   time.Duration
+    requireHTTP2    bool
+    configErr       error        // from an option that failed to load its input
+    mu              sync.RWMutex // guards defaultHeaders and hooks
 }
 
-// NewHTTPClient creates a new HTTP client with retry capabilities
-func NewHTTPClient(baseURL string, timeout time.Duration) *HTTPClient {
-    return &HTTPClient{
-        client: &http.Client{
-            Timeout: timeout,
-        },
-        maxRetries: 3,
-        retryDelay: time.Second,
-        baseURL:    baseURL,
+// RequestHook is called just before each attempt is sent; attempt is 0-based
+type RequestHook func(req *http.Request, attempt int)
+
+// ResponseHook is called after each attempt with its response or transport error and latency
+type ResponseHook func(resp *http.Response, err error, attempt int, latency time.Duration)
+
+// callTracer wraps each overall call (not each retry) in a trace span. It is
+// implemented behind the otel build tag so the core client has no tracing dependency.
+type callTracer interface {
+    start(ctx context.Context, method, url string) (context.Context, func(resp *http.Response, attempts int, err error))
+    inject(ctx context.Context, header http.Header)
+}
+
+// Metrics receives client observations, e.g. to export them to Prometheus
+type Metrics interface {
+    // ObserveRequest is called once per call; status is 0 if no response was received
+    ObserveRequest(method, host string, status int, duration time.Duration)
+    // ObserveRetry is called each time an attempt is retried
+    ObserveRetry(method, host string)
+}
+
+// noopMetrics discards all observations
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveRequest(method, host string, status int, duration time.Duration) {}
+func (noopMetrics) ObserveRetry(method, host string)                                       {}
+
+// Logger receives diagnostic messages such as retry attempts
+type Logger interface {
+    Debugf(format string, args ...interface{})
+    Infof(format string, args ...interface{})
+    Warnf(format string, args ...interface{})
+}
+
+// noopLogger discards all messages
+type noopLogger struct{}
+
+func (noopLogger) Debugf(format string, args ...interface{}) {}
+func (noopLogger) Infof(format string, args ...interface{})  {}
+func (noopLogger) Warnf(format string, args ...interface{})  {}
+
+// StdLogger adapts a standard library *log.Logger to Logger, prefixing each level
+type StdLogger struct {
+    *log.Logger
+}
+
+// NewStdLogger wraps l, or the standard logger when l is nil
+func NewStdLogger(l *log.Logger) StdLogger {
+    if l == nil {
+        l = log.Default()
     }
+    return StdLogger{Logger: l}
 }
 
-// GET performs an HTTP GET request with automatic retries
-func (c *HTTPClient) GET(endpoint string, headers map[string]string) (*Response, error) {
-    url := c.baseURL + endpoint
+func (l StdLogger) Debugf(format string, args ...interface{}) { l.Printf("DEBUG "+format, args...) }
+func (l StdLogger) Infof(format string, args ...interface{})  { l.Printf("INFO "+format, args...) }
+func (l StdLogger) Warnf(format string, args ...interface{})  { l.Printf("WARN "+format, args...) }
 
-    for attempt := 0; attempt <= c.maxRetries; attempt++ {
-        req, err := http.NewRequest("GET", url, nil)
-        if err != nil {
-            return nil, fmt.Errorf("creating request: %w", err)
+// BackoffStrategy computes how long to wait before the given retry attempt (0-based)
+type BackoffStrategy interface {
+    NextDelay(attempt int) time.Duration
+}
+
+// LinearBackoff waits Delay * (attempt+1) between retries
+type LinearBackoff struct {
+    Delay time.Duration
+}
+
+// NextDelay returns a linearly increasing delay
+func (b LinearBackoff) NextDelay(attempt int) time.Duration {
+    return b.Delay * time.Duration(attempt+1)
+}
+
+// ExponentialBackoff waits Base * 2^attempt, capped at Max.
+// With Jitter set, the delay is drawn uniformly from [0, capped delay] (full jitter).
+type ExponentialBackoff struct {
+    Base   time.Duration
+    Max    time.Duration
+    Jitter bool
+}
+
+// NextDelay returns an exponentially increasing, optionally jittered delay
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+    delay := b.Base
+    for i := 0; i < attempt; i++ {
+        delay *= 2
+        if b.Max > 0 && delay >= b.Max {
+            delay = b.Max
+            break
         }
+    }
+    if b.Max > 0 && delay > b.Max {
+        delay = b.Max
+    }
 
-        // Add headers
-        for key, value := range headers {
-            req.Header.Set(key, value)
+    if b.Jitter && delay > 0 {
+        delay = time.Duration(rand.Int63n(int64(delay) + 1))
+    }
+    return delay
+}
+
+// Option configures an HTTPClient at construction time
+type Option func(*HTTPClient)
+
+// WithMaxRetries sets how many times a failed request is retried.
+// With n = 0 every call makes exactly one attempt: network errors and
+// retryable statuses (5xx, 429) are returned as-is and no backoff or
+// Retry-After wait ever happens. It panics if n is negative.
+func WithMaxRetries(n int) Option {
+    if n < 0 {
+        panic(fmt.Sprintf("WithMaxRetries: maxRetries must be non-negative, got %d", n))
+    }
+    return func(c *HTTPClient) {
+        c.maxRetries = n
+    }
+}
+
+// WithoutRetries disables the built-in retries, for callers that wrap the client
+// in their own retry logic. It is WithMaxRetries(0).
+func WithoutRetries() Option {
+    return WithMaxRetries(0)
+}
+
+// WithRetryDelay sets the base delay between retries
+func WithRetryDelay(d time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.retryDelay = d
+    }
+}
+
+// WithHTTPClient replaces the underlying http.Client, e.g. to inject a custom transport.
+// The injected client is used as-is, so the constructor timeout and any transport
+// options (WithMaxIdleConns and friends) are not applied to it. If hc has no
+// CheckRedirect of its own, the client's redirect limit and Authorization policy
+// are installed on a copy of it, leaving hc itself untouched.
+func WithHTTPClient(hc *http.Client) Option {
+    return func(c *HTTPClient) {
+        c.client = hc
+        c.customClient = true
+    }
+}
+
+// WithTransport sends requests through rt, e.g. a MockTransport in tests. The
+// constructor timeout still applies, but transport options such as WithMaxIdleConns
+// and WithH2C configure the default transport and are ignored when rt is set.
+func WithTransport(rt http.RoundTripper) Option {
+    return func(c *HTTPClient) {
+        c.transport = rt
+    }
+}
+
+// WithMaxIdleConns limits idle keep-alive connections across all hosts
+func WithMaxIdleConns(n int) Option {
+    return withTransport(func(t *http.Transport) {
+        t.MaxIdleConns = n
+    })
+}
+
+// WithMaxIdleConnsPerHost limits idle keep-alive connections kept per host
+func WithMaxIdleConnsPerHost(n int) Option {
+    return withTransport(func(t *http.Transport) {
+        t.MaxIdleConnsPerHost = n
+    })
+}
+
+// WithRequestTimeout bounds each attempt from dialing until the body is fully read,
+// replacing the timeout passed to NewHTTPClient. Zero removes the limit, which suits
+// large downloads when paired with WithConnectTimeout and WithResponseHeaderTimeout.
+func WithRequestTimeout(d time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.requestTimeout = d
+    }
+}
+
+// WithConnectTimeout bounds how long establishing a connection may take, including
+// one to a WithUnixSocket socket. (WithDialTimeout is the websocket equivalent.)
+func WithConnectTimeout(d time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.connectTimeout = d
+    }
+}
+
+// WithUnixSocket sends every request over the Unix domain socket at socketPath, as
+// when talking to a local daemon like Docker. The base URL still supplies the path
+// and Host header, so its host can be a placeholder such as "http://localhost".
+// Proxies are bypassed.
+func WithUnixSocket(socketPath string) Option {
+    return func(c *HTTPClient) {
+        c.socketPath = socketPath
+    }
+}
+
+// configureDialer installs the dialer described by WithConnectTimeout and WithUnixSocket
+func (c *HTTPClient) configureDialer(t *http.Transport) {
+    dialer := &net.Dialer{Timeout: c.connectTimeout, KeepAlive: 30 * time.Second}
+    if c.socketPath == "" {
+        t.DialContext = dialer.DialContext
+        return
+    }
+    socketPath := c.socketPath
+    t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+        return dialer.DialContext(ctx, "unix", socketPath)
+    }
+    t.Proxy = nil
+}
+
+// ErrHTTP2Required is returned under WithForceHTTP2 when a server answers over HTTP/1.x
+var ErrHTTP2Required = errors.New("server did not negotiate HTTP/2")
+
+// WithForceHTTP2(true) requires HTTP/2: TLS connections are configured for it even
+// alongside a custom TLS config or dialer, and a response that arrives over HTTP/1.x
+// fails the call with ErrHTTP2Required instead of being retried. Cleartext http://
+// URLs need WithH2C as well. false, the default, negotiates HTTP/2 when the server
+// offers it and falls back to HTTP/1.1; check Response.Proto to see which was used.
+func WithForceHTTP2(require bool) Option {
+    return func(c *HTTPClient) {
+        c.requireHTTP2 = require
+    }
+}
+
+// requireHTTP2Transport rejects responses that did not arrive over HTTP/2
+type requireHTTP2Transport struct {
+    base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *requireHTTP2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    resp, err := t.base.RoundTrip(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.ProtoMajor != 2 {
+        drainAndClose(resp)
+        return nil, fmt.Errorf("%s: %w", resp.Proto, ErrHTTP2Required)
+    }
+    return resp, nil
+}
+
+// WithH2C sends http:// requests as cleartext HTTP/2 (h2c) with prior knowledge, for
+// internal services that speak HTTP/2 without TLS. The server must support h2c, as
+// there is no fallback to HTTP/1.1. https:// requests use the regular transport.
+// Proxy settings do not apply to h2c requests.
+func WithH2C(enabled bool) Option {
+    return func(c *HTTPClient) {
+        c.h2c = enabled
+    }
+}
+
+// WithResponseHeaderTimeout bounds the wait for response headers once a request has
+// been written, without limiting how long the body takes to arrive
+func WithResponseHeaderTimeout(d time.Duration) Option {
+    return withTransport(func(t *http.Transport) {
+        t.ResponseHeaderTimeout = d
+    })
+}
+
+// WithIdleConnTimeout closes idle connections after d
+func WithIdleConnTimeout(d time.Duration) Option {
+    return withTransport(func(t *http.Transport) {
+        t.IdleConnTimeout = d
+    })
+}
+
+// WithDisableKeepAlives opens a new connection per request, which helps when debugging
+func WithDisableKeepAlives(disable bool) Option {
+    return withTransport(func(t *http.Transport) {
+        t.DisableKeepAlives = disable
+    })
+}
+
+// WithProxy sends all requests through the proxy at proxyURL.
+// It panics if proxyURL cannot be parsed.
+func WithProxy(proxyURL string) Option {
+    parsed, err := url.Parse(proxyURL)
+    if err != nil {
+        panic(fmt.Sprintf("WithProxy: invalid proxy URL: %v", err))
+    }
+    return WithProxyFunc(http.ProxyURL(parsed))
+}
+
+// WithProxyFromEnvironment selects proxies from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func WithProxyFromEnvironment() Option {
+    return WithProxyFunc(http.ProxyFromEnvironment)
+}
+
+// WithProxyFunc chooses a proxy per request; returning a nil URL connects directly
+func WithProxyFunc(proxy func(*http.Request) (*url.URL, error)) Option {
+    return withTransport(func(t *http.Transport) {
+        t.Proxy = proxy
+    })
+}
+
+// WithTLSConfig uses cfg for TLS connections. The other TLS options, such as
+// WithRootCAs, adjust a copy of this config wherever they appear in the list.
+func WithTLSConfig(cfg *tls.Config) Option {
+    return func(c *HTTPClient) {
+        c.tlsConfig = cfg.Clone()
+    }
+}
+
+// WithClientCertificate presents the PEM key pair for mutual TLS. If the files
+// cannot be loaded, every request fails with a *RequestError wrapping the cause.
+func WithClientCertificate(certFile, keyFile string) Option {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return withConfigError(fmt.Errorf("WithClientCertificate: loading key pair: %w", err))
+    }
+    return withTLS(func(cfg *tls.Config) {
+        cfg.Certificates = append(cfg.Certificates, cert)
+    })
+}
+
+// WithRootCAs trusts only the PEM certificates in caFile when verifying servers.
+// If the file cannot be read or holds no certificates, every request fails with a
+// *RequestError wrapping the cause.
+func WithRootCAs(caFile string) Option {
+    pem, err := ioutil.ReadFile(caFile)
+    if err != nil {
+        return withConfigError(fmt.Errorf("WithRootCAs: reading CA file: %w", err))
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+        return withConfigError(fmt.Errorf("WithRootCAs: no certificates found in %s", caFile))
+    }
+    return withTLS(func(cfg *tls.Config) {
+        cfg.RootCAs = pool
+    })
+}
+
+// WithInsecureSkipVerify disables server certificate verification.
+// WARNING: this makes connections vulnerable to interception; use it only
+// for testing against self-signed certificates.
+func WithInsecureSkipVerify(skip bool) Option {
+    return withTLS(func(cfg *tls.Config) {
+        cfg.InsecureSkipVerify = skip
+    })
+}
+
+// withConfigError records a setup failure that requests then report; the first one wins
+func withConfigError(err error) Option {
+    return func(c *HTTPClient) {
+        if c.configErr == nil {
+            c.configErr = err
         }
+    }
+}
 
-        resp, err := c.client.Do(req)
-        if err != nil {
-            if attempt < c.maxRetries {
-                time.Sleep(c.retryDelay * time.Duration(attempt+1))
-                continue
-            }
-            return nil, fmt.Errorf("request failed after %d attempts: %w", c.maxRetries, err)
+// withTLS adjusts the transport's TLS config, creating one if needed
+func withTLS(configure func(*tls.Config)) Option {
+    return withTransport(func(t *http.Transport) {
+        if t.TLSClientConfig == nil {
+            t.TLSClientConfig = &tls.Config{}
         }
+        configure(t.TLSClientConfig)
+    })
+}
 
-        return c.parseResponse(resp)
+// WithMaxRedirects follows at most n redirects, returning the last 3xx response
+// once the limit is reached. Like the other redirect settings, it has no effect on
+// a WithHTTPClient client that sets its own CheckRedirect.
+func WithMaxRedirects(n int) Option {
+    return func(c *HTTPClient) {
+        c.maxRedirects = n
     }
+}
 
-    return nil, fmt.Errorf("max retries exceeded")
+// WithFollowRedirects(false) returns 3xx responses as-is, with Location intact,
+// instead of following them
+func WithFollowRedirects(follow bool) Option {
+    return func(c *HTTPClient) {
+        if follow {
+            c.maxRedirects = defaultMaxRedirects
+        } else {
+            c.maxRedirects = 0
+        }
+    }
 }
 
-// POST sends JSON data to an endpoint
-func (c *HTTPClient) POST(endpoint string, data interface{}, headers map[string]string) (*Response, error) {
-    url := c.baseURL + endpoint
+// WithCookieJar keeps cookies set by servers and sends them on later requests
+func WithCookieJar() Option {
+    return func(c *HTTPClient) {
+        c.jar = newSessionJar()
+    }
+}
 
-    jsonData, err := json.Marshal(data)
-    if err != nil {
-        return nil, fmt.Errorf("marshaling data: %w", err)
+// WithCustomCookieJar stores cookies in jar instead of the built-in jar
+func WithCustomCookieJar(jar http.CookieJar) Option {
+    return func(c *HTTPClient) {
+        c.jar = jar
     }
+}
 
-    for attempt := 0; attempt <= c.maxRetries; attempt++ {
-        req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-        if err != nil {
-            return nil, fmt.Errorf("creating request: %w", err)
+// WithMetrics reports request counts, latencies and retries to m
+func WithMetrics(m Metrics) Option {
+    return func(c *HTTPClient) {
+        if m == nil {
+            m = noopMetrics{}
+        }
+        c.metrics = m
+    }
+}
+
+// WithIdempotencyKeys attaches a random Idempotency-Key to each POST call, reused
+// across its retries so the server can drop duplicates. A key passed in the call's
+// headers takes precedence.
+func WithIdempotencyKeys(enabled bool) Option {
+    return func(c *HTTPClient) {
+        c.idempotencyKeys = enabled
+    }
+}
+
+// WithMaxResponseSize fails calls whose body, after decompression, exceeds n bytes
+// with a *RequestError wrapping ErrResponseTooLarge. By default response size is unlimited.
+func WithMaxResponseSize(n int64) Option {
+    return func(c *HTTPClient) {
+        c.maxResponseSize = n
+    }
+}
+
+// WithLogger logs retry attempts and final failures to l
+func WithLogger(l Logger) Option {
+    return func(c *HTTPClient) {
+        if l == nil {
+            l = noopLogger{}
         }
+        c.logger = l
+    }
+}
 
-        req.Header.Set("Content-Type", "application/json")
-        for key, value := range headers {
-            req.Header.Set(key, value)
+// WithHealthEndpoint sets the endpoint Ping checks, "/" by default
+func WithHealthEndpoint(endpoint string) Option {
+    return func(c *HTTPClient) {
+        c.healthEndpoint = endpoint
+    }
+}
+
+// withTransport queues a change to the client's transport, applied once all options
+// have run unless WithHTTPClient supplied a client
+func withTransport(configure func(*http.Transport)) Option {
+    return func(c *HTTPClient) {
+        c.transportConfig = append(c.transportConfig, configure)
+    }
+}
+
+// WithBackoff replaces the default linear backoff with a custom strategy
+func WithBackoff(b BackoffStrategy) Option {
+    return func(c *HTTPClient) {
+        c.backoff = b
+    }
+}
+
+// WithMaxRetryAfter caps how long a server's Retry-After header can make the client wait
+func WithMaxRetryAfter(d time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.maxRetryAfter = d
+    }
+}
+
+// WithRetryableStatuses sets the response status codes that trigger a retry,
+// replacing the default of any 5xx or 429
+func WithRetryableStatuses(codes ...int) Option {
+    return func(c *HTTPClient) {
+        c.retryStatuses = make(map[int]bool, len(codes))
+        for _, code := range codes {
+            c.retryStatuses[code] = true
         }
+    }
+}
 
-        resp, err := c.client.Do(req)
-        if err != nil {
-            if attempt < c.maxRetries {
-                time.Sleep(c.retryDelay * time.Duration(attempt+1))
-                continue
-            }
-            return nil, fmt.Errorf("request failed after %d attempts: %w", c.maxRetries, err)
+// WithRawBody is WithAutoDecompress(false): Response.Body holds the bytes as sent
+func WithRawBody() Option {
+    return WithAutoDecompress(false)
+}
+
+// WithAutoDecompress controls compressed responses. When enabled, the default,
+// buffered calls send "Accept-Encoding: gzip, deflate" unless the caller set one,
+// and gzip or deflate bodies are decoded in the client itself, so decoding works
+// even with a transport that has DisableCompression set. Disabling it also turns
+// off the transport's own gzip handling, so Response.Body and Content-Encoding are
+// exactly what the server sent: uncompressed unless the caller asked for an
+// encoding with its own Accept-Encoding header.
+func WithAutoDecompress(enabled bool) Option {
+    return func(c *HTTPClient) {
+        c.autoDecompress = enabled
+    }
+}
+
+// WithRequestCompression gzips JSON and raw request bodies of at least threshold
+// bytes and sends them with "Content-Encoding: gzip". Only use it with servers
+// that accept compressed requests. A threshold of 0 or less disables compression.
+func WithRequestCompression(threshold int) Option {
+    return func(c *HTTPClient) {
+        c.compressAbove = threshold
+    }
+}
+
+// WithBufferPool reads response bodies into buffers drawn from a shared pool instead
+// of allocating a new slice per response. Call Response.Release once done with Body
+// to return its buffer; responses that are never released are simply collected.
+func WithBufferPool() Option {
+    return func(c *HTTPClient) {
+        c.bufferPool = &sync.Pool{
+            New: func() interface{} { return new(bytes.Buffer) },
         }
+    }
+}
 
-        if resp.StatusCode >= 500 && attempt < c.maxRetries {
-            resp.Body.Close()
-            time.Sleep(c.retryDelay * time.Duration(attempt+1))
-            continue
+// WithErrorResponse decodes the JSON body of every 4xx or 5xx response into a value
+// from newValue, e.g. func() interface{} { return new(MyAPIError) }. The call then
+// returns the Response together with a *RequestError wrapping an *APIError that
+// holds the decoded value; use errors.As to reach it. Bodies that don't decode are
+// reported as a plain *RequestError.
+func WithErrorResponse(newValue func() interface{}) Option {
+    return func(c *HTTPClient) {
+        c.errorResponse = newValue
+    }
+}
+
+// WithRequestSigner calls sign on every attempt once the request is fully built,
+// just before it is sent, so schemes such as AWS SigV4 or HMAC that cover headers,
+// timestamps and a body hash are recomputed for each retry. Request bodies are
+// buffered in memory while a signer is set; the signer can read them through
+// req.GetBody or from req.Body directly, and a fresh copy is sent either way.
+// Request hooks run after signing and should not alter signed headers. A signing
+// error fails the call without retrying.
+func WithRequestSigner(sign func(req *http.Request) error) Option {
+    return func(c *HTTPClient) {
+        c.signer = sign
+    }
+}
+
+// WithRetryPredicate lets shouldRetry decide whether an attempt is retried, in place
+// of the status-based rules. It receives the attempt's parsed Response with a nil
+// error, or a nil Response and the transport error. Bodies are read in full before
+// shouldRetry sees them, including for streaming calls such as GETStream. Retry
+// counts, backoff and Retry-After still apply.
+func WithRetryPredicate(shouldRetry func(resp *Response, err error) bool) Option {
+    return func(c *HTTPClient) {
+        c.retryPredicate = shouldRetry
+    }
+}
+
+// WithDefaultHeaders sets headers sent with every request; per-call headers win on conflict
+func WithDefaultHeaders(headers map[string]string) Option {
+    return func(c *HTTPClient) {
+        for key, value := range headers {
+            c.setDefaultHeader(key, value)
         }
+    }
+}
 
-        return c.parseResponse(resp)
+// WithCircuitBreaker fails requests fast with ErrCircuitOpen after failureThreshold
+// consecutive failed attempts, probing again once cooldown has elapsed. Without
+// WithCircuitBreakerWindow, failures count however far apart they are.
+func WithCircuitBreaker(failureThreshold int, cooldown time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.breaker = &circuitBreaker{threshold: failureThreshold, cooldown: cooldown}
     }
+}
 
-    return nil, fmt.Errorf("max retries exceeded")
+// WithCircuitBreakerWindow makes the breaker trip only when its consecutive failures
+// all fall within window of the first one; a failure after that starts a new run
+func WithCircuitBreakerWindow(window time.Duration) Option {
+    return func(c *HTTPClient) {
+        c.breakerWindow = window
+    }
 }
 
-// Response represents an HTTP response
-type Response struct {
-    StatusCode int
-    Body       []byte
-    Headers    http.Header
+// WithRateLimit caps outbound requests with a token bucket. Calls block until a
+// token is available; retries of the same call do not consume extra tokens unless
+// WithRateLimitRetries is set.
+func WithRateLimit(requestsPerSecond float64, burst int) Option {
+    return func(c *HTTPClient) {
+        c.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+    }
 }
 
-// parseResponse reads and parses the HTTP response
-func (c *HTTPClient) parseResponse(resp *http.Response) (*Response, error) {
-    defer resp.Body.Close()
+// WithRateLimitRetries makes each retry attempt wait for its own rate-limit token
+func WithRateLimitRetries() Option {
+    return func(c *HTTPClient) {
+        c.limitRetries = true
+    }
+}
 
-    body, err := ioutil.ReadAll(resp.Body)
-    if err != nil {
-        return nil, fmt.Errorf("reading response body: %w", err)
+// WithResponseCache keeps up to maxEntries fresh GET responses in memory,
+// honoring Cache-Control, Expires and Vary
+func WithResponseCache(maxEntries int) Option {
+    return func(c *HTTPClient) {
+        c.cache = newResponseCache(maxEntries)
     }
+}
 
-    return &Response{
-        StatusCode: resp.StatusCode,
-        Body:       body,
-        Headers:    resp.Header,
-    }, nil
+// WithConditionalRequests stores ETags for GET responses and revalidates them with
+// If-None-Match, serving the cached body when the server answers 304 Not Modified.
+// It uses the response cache, creating a default-sized one if none is configured.
+func WithConditionalRequests() Option {
+    return func(c *HTTPClient) {
+        c.conditional = true
+    }
 }
 
-// WebSocketConnection manages websocket connections
-type WebSocketConnection struct {
-    url         string
-    isConnected bool
-    reconnect   bool
+// NewHTTPClient creates a new HTTP client with retry capabilities
+func NewHTTPClient(baseURL string, timeout time.Duration, opts ...Option) *HTTPClient {
+    c := &HTTPClient{
+        client:         &http.Client{},
+        requestTimeout: timeout,
+        autoDecompress: true,
+        maxRetries:     3,
+        retryDelay:     time.Second,
+        maxRetryAfter:  time.Minute,
+        maxRedirects:   defaultMaxRedirects,
+        metrics:        noopMetrics{},
+        stats:          newHostStatsTracker(),
+        logger:         noopLogger{},
+        healthEndpoint: "/",
+        baseURL:        baseURL,
+    }
+
+    for _, opt := range opts {
+        opt(c)
+    }
+
+    if !c.customClient {
+        c.client.Timeout = c.requestTimeout
+        c.client.CheckRedirect = c.checkRedirect
+        if c.jar != nil {
+            c.client.Jar = c.jar
+        }
+    } else if c.client.CheckRedirect == nil {
+        hc := *c.client
+        hc.CheckRedirect = c.checkRedirect
+        c.client = &hc
+    }
+
+    if c.breaker != nil {
+        c.breaker.window = c.breakerWindow
+    }
+
+    // Assembled here rather than in the options so their order doesn't matter
+    if c.tlsConfig != nil {
+        base := c.tlsConfig
+        c.transportConfig = append([]func(*http.Transport){func(t *http.Transport) {
+            t.TLSClientConfig = base.Clone()
+        }}, c.transportConfig...)
+    }
+    if c.connectTimeout > 0 || c.socketPath != "" {
+        c.transportConfig = append(c.transportConfig, c.configureDialer)
+    }
+
+    if !c.autoDecompress {
+        c.transportConfig = append(c.transportConfig, func(t *http.Transport) {
+            t.DisableCompression = true
+        })
+    }
+
+    if c.requireHTTP2 {
+        c.transportConfig = append(c.transportConfig, func(t *http.Transport) {
+            // The only failure is a transport already set up for h2, which is fine here
+            http2.ConfigureTransport(t)
+        })
+    }
+
+    if c.transport != nil && !c.customClient {
+        c.client.Transport = c.transport
+    } else if len(c.transportConfig) > 0 && !c.customClient {
+        transport := http.DefaultTransport.(*http.Transport).Clone()
+        for _, configure := range c.transportConfig {
+            configure(transport)
+        }
+        c.client.Transport = transport
+    }
+
+    if c.h2c && c.transport == nil && !c.customClient {
+        c.client.Transport = newH2CTransport(c.client.Transport)
+    }
+
+    if c.requireHTTP2 && c.transport == nil && !c.customClient {
+        base := c.client.Transport
+        if base == nil {
+            base = http.DefaultTransport
+        }
+        c.client.Transport = &requireHTTP2Transport{base: base}
+    }
+
+    if c.conditional {
+        if c.cache == nil {
+            c.cache = newResponseCache(defaultCacheEntries)
+        }
+        c.cache.conditional = true
+    }
+
+    return c
 }
 
-// Connect establishes a websocket connection
-func (ws *WebSocketConnection) Connect() error {
-    // Implementation would use gorilla/websocket or similar
-    ws.isConnected = true
+// Cookies returns the cookies the jar would send to rawURL
+func (c *HTTPClient) Cookies(rawURL string) ([]*http.Cookie, error) {
+    if c.client.Jar == nil {
+        return nil, fmt.Errorf("no cookie jar configured")
+    }
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, fmt.Errorf("parsing cookie URL: %w", err)
+    }
+    return c.client.Jar.Cookies(u), nil
+}
+
+// ClearCookies discards every cookie in the jar installed by WithCookieJar
+func (c *HTTPClient) ClearCookies() error {
+    jar, ok := c.client.Jar.(*sessionJar)
+    if !ok {
+        return fmt.Errorf("cookie jar does not support clearing")
+    }
+    jar.reset()
     return nil
 }
 
-// SendMessage sends a message through the websocket
-func (ws *WebSocketConnection) SendMessage(message []byte) error {
-    if !ws.isConnected {
-        return fmt.Errorf("websocket not connected")
+// sessionJar is a cookiejar.Jar that can be emptied while requests are in flight
+type sessionJar struct {
+    mu  sync.RWMutex
+    jar *cookiejar.Jar
+}
+
+// newSessionJar creates an empty session jar
+func newSessionJar() *sessionJar {
+    jar, _ := cookiejar.New(nil) // New never fails with nil options
+    return &sessionJar{jar: jar}
+}
+
+// SetCookies implements http.CookieJar
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+    j.mu.RLock()
+    defer j.mu.RUnlock()
+    j.jar.SetCookies(u, cookies)
+}
+
+// Cookies implements http.CookieJar
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+    j.mu.RLock()
+    defer j.mu.RUnlock()
+    return j.jar.Cookies(u)
+}
+
+// reset swaps in an empty jar
+func (j *sessionJar) reset() {
+    fresh, _ := cookiejar.New(nil)
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.jar = fresh
+}
+
+// defaultMaxRedirects matches the standard library's redirect limit
+const defaultMaxRedirects = 10
+
+// checkRedirect enforces the redirect limit and drops Authorization when a
+// redirect leaves the original host
+func (c *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+    if len(via) > c.maxRedirects {
+        return http.ErrUseLastResponse
+    }
+    if req.URL.Host != via[0].URL.Host {
+        req.Header.Del("Authorization")
     }
-    // Send implementation
     return nil
 }
+
+// h2cTransport sends cleartext requests over HTTP/2 and everything else through base
+type h2cTransport struct {
+    h2c  *http2.Transport
+    base http.RoundTripper
+}
+
+// newH2CTransport wraps base, which may be nil for http.DefaultTransport. Cleartext
+// connections are dialed with base's DialContext, so socket and connect timeout
+// settings apply to h2c too; proxies are not, as h2c has no way through them.
+func newH2CTransport(base http.RoundTripper) *h2cTransport {
+    if base == nil {
+        base = http.DefaultTransport
+    }
+    dial := (&net.Dialer{}).DialContext
+    if t, ok := base.(*http.Transport); ok && t.DialContext != nil {
+        dial = t.DialContext
+    }
+    return &h2cTransport{
+        h2c: &http2.Transport{
+            AllowHTTP: true,
+            DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+                return dial(ctx, network, addr)
+            },
+        },
+        base: base,
+    }
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.URL.Scheme == "http" {
+        return t.h2c.RoundTrip(req)
+    }
+    return t.base.RoundTrip(req)
+}
+
+// SetAuthToken sends "Authorization: Bearer <token>" with every request
+func (c *HTTPClient) SetAuthToken(token string) {
+    c.SetBearerToken(token)
+}
+
+// SetBearerToken sends "Authorization: Bearer <token>" with every request
+func (c *HTTPClient) SetBearerToken(token string) {
+    c.setDefaultHeader("Authorization", "Bearer "+token)
+}
+
+// SetBasicAuth sends RFC 7617 basic credentials with every request
+func (c *HTTPClient) SetBasicAuth(username, password string) {
+    credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+    c.setDefaultHeader("Authorization", "Basic "+credentials)
+}
+
+// OnRequest registers a hook that runs before every attempt, including retries
+func (c *HTTPClient) OnRequest(hook RequestHook) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.requestHooks = append(c.requestHooks, hook)
+}
+
+// OnResponse registers a hook that runs after every attempt, including retries
+func (c *HTTPClient) OnResponse(hook ResponseHook) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.responseHooks = append(c.responseHooks, hook)
+}
+
+// setDefaultHeader stores a header applied to every request
+func (c *HTTPClient) setDefaultHeader(key, value string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.defaultHeaders == nil {
+        c.defaultHeaders = make(map[string]string)
+    }
+    c.defaultHeaders[http.CanonicalHeaderKey(key)] = value
+}
+
+// requestHeader merges default headers with per-call headers, which win on conflict
+func (c *HTTPClient) requestHeader(headers map[string]string) http.Header {
+    merged := make(http.Header, len(headers))
+    c.mu.RLock()
+    for key, value := range c.defaultHeaders {
+        merged.Set(key, value)
+    }
+    c.mu.RUnlock()
+
+    for key, value := range headers {
+        merged.Set(key, value)
+    }
+    return merged
+}
+
+// applyHeaders sets default headers and then per-call headers on req. As with
+// redirects, a default Authorization header is not sent to an absolute URL on a
+// host other than the base URL's; a client without a base host sends it everywhere.
+func (c *HTTPClient) applyHeaders(req *http.Request, headers map[string]string) {
+    merged := c.requestHeader(headers)
+    if c.foreignHost(req.URL) && !hasHeader(headers, "Authorization") {
+        merged.Del("Authorization")
+    }
+    for key, values := range merged {
+        req.Header[key] = values
+    }
+}
+
+// GET performs an HTTP GET request with automatic retries. Like every request
+// method, it accepts an absolute http(s) URL in place of an endpoint.
+func (c *HTTPClient) GET(endpoint string, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "GET", endpoint, nil, headers)
+}
+
+// POST sends JSON data to an endpoint
+func (c *HTTPClient) POST(endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "POST", endpoint, data, headers)
+}
+
+// PUT replaces a resource with JSON data
+func (c *HTTPClient) PUT(endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "PUT", endpoint, data, headers)
+}
+
+// PATCH partially updates a resource with JSON data
+func (c *HTTPClient) PATCH(endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "PATCH", endpoint, data, headers)
+}
+
+// DELETE removes a resource; data may be nil when no body is needed. Any body the
+// server returns, such as the deleted resource, is kept in Response.Body, which is
+// empty for 204 No Content.
+func (c *HTTPClient) DELETE(endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "DELETE", endpoint, data, headers)
+}
+
+// HEAD fetches only the status and headers for an endpoint
+func (c *HTTPClient) HEAD(endpoint string, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "HEAD", endpoint, nil, headers)
+}
+
+// OPTIONS asks an endpoint which methods and CORS settings it supports
+func (c *HTTPClient) OPTIONS(endpoint string, headers map[string]string) (*Response, error) {
+    return c.do(context.Background(), "OPTIONS", endpoint, nil, headers)
+}
+
+// ErrBodyNotReplayable is returned by Do for a request body that can't be resent on retry
+var ErrBodyNotReplayable = errors.New("request body is set but GetBody is nil")
+
+// Do sends a caller-built request through the client's retries, rate limiter and
+// response parsing, for cases the convenience methods don't cover such as custom
+// methods or trailers. A relative req.URL is resolved against the base URL, and req's
+// context, headers, trailers and Host are used on every attempt, with req's headers
+// overriding the client defaults. A body must come with GetBody so that it can be
+// rebuilt for retries; http.NewRequest sets it for bytes and strings readers.
+func (c *HTTPClient) Do(req *http.Request) (*Response, error) {
+    var newBody bodyFunc
+    if req.Body != nil && req.Body != http.NoBody {
+        defer req.Body.Close()
+        if req.GetBody == nil {
+            return nil, ErrBodyNotReplayable
+        }
+        newBody = func() (io.Reader, string, error) {
+            body, err := req.GetBody()
+            return body, "", err
+        }
+    }
+
+    method := req.Method
+    if method == "" {
+        method = "GET"
+    }
+    ctx := context.WithValue(req.Context(), requestTemplateKey{}, req)
+    return c.send(ctx, method, req.URL.String(), newBody, nil)
+}
+
+// requestTemplateKey is the context key for the request passed to Do
+type requestTemplateKey struct{}
+
+// applyTemplate copies what Do promises to keep from the caller's request onto an attempt
+func applyTemplate(req, tmpl *http.Request) {
+    for key, values := range tmpl.Header {
+        req.Header[key] = append([]string(nil), values...)
+    }
+    if tmpl.Trailer != nil {
+        req.Trailer = tmpl.Trailer.Clone()
+    }
+    if tmpl.Host != "" {
+        req.Host = tmpl.Host
+    }
+    if req.Body != nil && tmpl.ContentLength > 0 {
+        req.ContentLength = tmpl.ContentLength
+    }
+    req.Close = tmpl.Close
+}
+
+// GETWithParams performs a GET with params percent-encoded into the query string.
+// Repeated keys in params are sent as repeated query parameters.
+func (c *HTTPClient) GETWithParams(endpoint string, params url.Values, headers map[string]string) (*Response, error) {
+    return c.GET(appendQuery(endpoint, params), headers)
+}
+
+// GETJSON performs a GET and unmarshals a 2xx response body into out
+func (c *HTTPClient) GETJSON(endpoint string, headers map[string]string, out interface{}) (*Response, error) {
+    resp, err := c.GET(endpoint, headers)
+    if err != nil {
+        return resp, err
+    }
+    if !resp.IsSuccess() {
+        return resp, &RequestError{
+            Method:     "GET",
+            URL:        c.resolveURL(endpoint),
+            StatusCode: resp.StatusCode,
+            Err:        fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bodySnippet(resp.Body)),
+        }
+    }
+    if err := resp.JSON(out); err != nil {
+        return resp, err
+    }
+    return resp, nil
+}
+
+// DeleteJSON performs a DELETE and unmarshals a 2xx response body into out. An empty
+// body, as sent with 204 No Content, leaves out untouched.
+func (c *HTTPClient) DeleteJSON(endpoint string, headers map[string]string, out interface{}) (*Response, error) {
+    resp, err := c.DELETE(endpoint, nil, headers)
+    if err != nil {
+        return resp, err
+    }
+    if !resp.IsSuccess() {
+        return resp, &RequestError{
+            Method:     "DELETE",
+            URL:        c.resolveURL(endpoint),
+            StatusCode: resp.StatusCode,
+            Err:        fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bodySnippet(resp.Body)),
+        }
+    }
+    if len(bytes.TrimSpace(resp.Body)) == 0 {
+        return resp, nil
+    }
+    if err := resp.JSON(out); err != nil {
+        return resp, err
+    }
+    return resp, nil
+}
+
+// PostXML sends v marshaled as XML, preceded by the standard XML declaration
+func (c *HTTPClient) PostXML(endpoint string, v interface{}, headers map[string]string) (*Response, error) {
+    xmlData, err := xml.Marshal(v)
+    if err != nil {
+        return nil, fmt.Errorf("marshaling XML: %w", err)
+    }
+    xmlData = append([]byte(xml.Header), xmlData...)
+    xmlData, headers, err = c.compressBody(xmlData, headers)
+    if err != nil {
+        return nil, err
+    }
+
+    return c.send(context.Background(), "POST", endpoint, func() (io.Reader, string, error) {
+        return bytes.NewReader(xmlData), "application/xml", nil
+    }, headers)
+}
+
+// PostForm sends form as application/x-www-form-urlencoded
+func (c *HTTPClient) PostForm(endpoint string, form url.Values, headers map[string]string) (*Response, error) {
+    encoded := form.Encode()
+    return c.send(context.Background(), "POST", endpoint, func() (io.Reader, string, error) {
+        return strings.NewReader(encoded), "application/x-www-form-urlencoded", nil
+    }, headers)
+}
+
+// PostRaw sends body as-is with the given Content-Type, gzipped if
+// WithRequestCompression applies
+func (c *HTTPClient) PostRaw(endpoint string, body []byte, contentType string, headers map[string]string) (*Response, error) {
+    body, headers, err := c.compressBody(body, headers)
+    if err != nil {
+        return nil, err
+    }
+    return c.send(context.Background(), "POST", endpoint, func() (io.Reader, string, error) {
+        return bytes.NewReader(body), contentType, nil
+    }, headers)
+}
+
+// PostReader streams body with the given Content-Type. The body is rewound to its
+// starting offset before every retry, which is why it must be seekable.
+func (c *HTTPClient) PostReader(endpoint string, body io.ReadSeeker, contentType string, headers map[string]string) (*Response, error) {
+    start, err := body.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return nil, fmt.Errorf("finding body offset: %w", err)
+    }
+
+    return c.send(context.Background(), "POST", endpoint, func() (io.Reader, string, error) {
+        if _, err := body.Seek(start, io.SeekStart); err != nil {
+            return nil, "", fmt.Errorf("rewinding body: %w", err)
+        }
+        // NopCloser stops the transport from closing a caller-owned file between retries
+        return ioutil.NopCloser(body), contentType, nil
+    }, headers)
+}
+
+// PostMultipart uploads form fields and files as multipart/form-data.
+// files maps form field names to local paths; file contents are streamed
+// and re-read from disk on every retry.
+func (c *HTTPClient) PostMultipart(endpoint string, fields map[string]string, files map[string]string, headers map[string]string) (*Response, error) {
+    for field, path := range files {
+        if _, err := os.Stat(path); err != nil {
+            return nil, fmt.Errorf("multipart file for field %q: %w", field, err)
+        }
+    }
+
+    return c.send(context.Background(), "POST", endpoint, func() (io.Reader, string, error) {
+        return multipartBody(fields, files)
+    }, headers)
+}
+
+// multipartBody streams a multipart form through a pipe so files are never fully buffered
+func multipartBody(fields map[string]string, files map[string]string) (io.Reader, string, error) {
+    pr, pw := io.Pipe()
+    writer := multipart.NewWriter(pw)
+
+    go func() {
+        pw.CloseWithError(writeMultipart(writer, fields, files))
+    }()
+
+    return pr, writer.FormDataContentType(), nil
+}
+
+// writeMultipart writes fields then files in key order and closes the form
+func writeMultipart(writer *multipart.Writer, fields map[string]string, files map[string]string) error {
+    for _, name := range sortedKeys(fields) {
+        if err := writer.WriteField(name, fields[name]); err != nil {
+            return err
+        }
+    }
+
+    for _, name := range sortedKeys(files) {
+        path := files[name]
+        part, err := writer.CreateFormFile(name, filepath.Base(path))
+        if err != nil {
+            return err
+        }
+        file, err := os.Open(path)
+        if err != nil {
+            return err
+        }
+        _, err = io.Copy(part, file)
+        file.Close()
+        if err != nil {
+            return err
+        }
+    }
+
+    return writer.Close()
+}
+
+// sortedKeys returns the map's keys in sorted order
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// DownloadFile streams a GET response to destPath without buffering it in memory
+func (c *HTTPClient) DownloadFile(endpoint, destPath string, headers map[string]string) error {
+    return c.DownloadFileWithProgress(endpoint, destPath, headers, nil)
+}
+
+// DownloadFileWithProgress is DownloadFile with an optional progress callback.
+// totalBytes is -1 when the server does not report a length. If destPath already
+// holds a partial download, the transfer resumes with a Range request.
+func (c *HTTPClient) DownloadFileWithProgress(endpoint, destPath string, headers map[string]string, progress func(bytesWritten, totalBytes int64)) error {
+    var offset int64
+    if info, err := os.Stat(destPath); err == nil && info.Mode().IsRegular() {
+        offset = info.Size()
+    }
+
+    reqHeaders := make(map[string]string, len(headers)+1)
+    for key, value := range headers {
+        reqHeaders[key] = value
+    }
+    if offset > 0 {
+        reqHeaders["Range"] = fmt.Sprintf("bytes=%d-", offset)
+    }
+
+    resp, err := c.roundTrip(context.Background(), "GET", endpoint, nil, reqHeaders)
+    if err != nil {
+        return err
+    }
+    defer drainAndClose(resp)
+
+    flags := os.O_WRONLY | os.O_CREATE
+    switch {
+    case resp.StatusCode == http.StatusPartialContent && offset > 0:
+        flags |= os.O_APPEND
+    case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+        // The partial file already holds the whole resource
+        if progress != nil {
+            progress(offset, offset)
+        }
+        return nil
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        // Server ignored the Range header; start over
+        offset = 0
+        flags |= os.O_TRUNC
+    default:
+        snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+        return &RequestError{
+            Method:     "GET",
+            URL:        c.resolveURL(endpoint),
+            StatusCode: resp.StatusCode,
+            Err:        fmt.Errorf("download failed with status %d: %s", resp.StatusCode, snippet),
+        }
+    }
+
+    total := int64(-1)
+    if resp.ContentLength >= 0 {
+        total = offset + resp.ContentLength
+    }
+
+    file, err := os.OpenFile(destPath, flags, 0644)
+    if err != nil {
+        return err
+    }
+
+    var dst io.Writer = file
+    if progress != nil {
+        dst = &progressWriter{w: file, written: offset, total: total, fn: progress}
+    }
+
+    if _, err := io.Copy(dst, resp.Body); err != nil {
+        file.Close()
+        return fmt.Errorf("writing download to %s: %w", destPath, err)
+    }
+    return file.Close()
+}
+
+// progressWriter reports cumulative bytes written to fn
+type progressWriter struct {
+    w       io.Writer
+    written int64
+    total   int64
+    fn      func(bytesWritten, totalBytes int64)
+}
+
+// Write forwards to the underlying writer and reports progress
+func (p *progressWriter) Write(b []byte) (int, error) {
+    n, err := p.w.Write(b)
+    p.written += int64(n)
+    p.fn(p.written, p.total)
+    return n, err
+}
+
+// Ping GETs the health endpoint once, without retries or the response cache, and
+// returns nil for a 2xx status. Bound how long a probe may take with ctx.
+func (c *HTTPClient) Ping(ctx context.Context) error {
+    ctx = ContextWithRequestOptions(ctx, RequestOptions{MaxRetries: Retries(0)})
+    resp, err := c.roundTrip(ctx, "GET", c.healthEndpoint, nil, nil)
+    if err != nil {
+        return err
+    }
+    drainAndClose(resp)
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return &RequestError{
+            Method:     "GET",
+            URL:        c.resolveURL(c.healthEndpoint),
+            Attempts:   1,
+            StatusCode: resp.StatusCode,
+            Err:        fmt.Errorf("health check failed with status %d", resp.StatusCode),
+        }
+    }
+    return nil
+}
+
+// GETStream copies the response body to w as it arrives instead of buffering it.
+// The body is written whatever the status, so check statusCode before trusting
+// what landed in w. Retries happen only until a final response arrives; once
+// copying starts, a failure is returned rather than retried.
+func (c *HTTPClient) GETStream(endpoint string, headers map[string]string, w io.Writer) (statusCode int, respHeaders http.Header, err error) {
+    resp, err := c.roundTrip(context.Background(), "GET", endpoint, nil, headers)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer drainAndClose(resp)
+
+    if _, err := io.Copy(w, resp.Body); err != nil {
+        return resp.StatusCode, resp.Header, fmt.Errorf("streaming response body: %w", err)
+    }
+    return resp.StatusCode, resp.Header, nil
+}
+
+// StreamJSONOptions controls GETStreamJSONWithOptions behavior
+type StreamJSONOptions struct {
+    // NDJSON reads newline-delimited JSON values instead of one top-level array
+    NDJSON bool
+}
+
+// GETStreamJSON decodes a top-level JSON array from the live response body, calling
+// fn with each element in turn so the whole array is never held in memory. It stops
+// at the first error from fn. A non-2xx response fails with *RequestError.
+func (c *HTTPClient) GETStreamJSON(endpoint string, headers map[string]string, fn func(json.RawMessage) error) error {
+    return c.GETStreamJSONWithOptions(endpoint, headers, StreamJSONOptions{}, fn)
+}
+
+// GETStreamJSONWithOptions is GETStreamJSON with options
+func (c *HTTPClient) GETStreamJSONWithOptions(endpoint string, headers map[string]string, opts StreamJSONOptions, fn func(json.RawMessage) error) error {
+    resp, err := c.roundTrip(context.Background(), "GET", endpoint, nil, headers)
+    if err != nil {
+        return err
+    }
+    defer drainAndClose(resp)
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+        return &RequestError{
+            Method:     "GET",
+            URL:        c.resolveURL(endpoint),
+            StatusCode: resp.StatusCode,
+            Err:        fmt.Errorf("unexpected status %d: %s", resp.StatusCode, snippet),
+        }
+    }
+
+    decoder := json.NewDecoder(resp.Body)
+    if opts.NDJSON {
+        for {
+            var element json.RawMessage
+            if err := decoder.Decode(&element); err != nil {
+                if err == io.EOF {
+                    return nil
+                }
+                return fmt.Errorf("decoding JSON stream: %w", err)
+            }
+            if err := fn(element); err != nil {
+                return err
+            }
+        }
+    }
+
+    token, err := decoder.Token()
+    if err != nil {
+        return fmt.Errorf("decoding JSON stream: %w", err)
+    }
+    if delim, ok := token.(json.Delim); !ok || delim != '[' {
+        return fmt.Errorf("decoding JSON stream: expected array, got %v", token)
+    }
+    for decoder.More() {
+        var element json.RawMessage
+        if err := decoder.Decode(&element); err != nil {
+            return fmt.Errorf("decoding JSON stream: %w", err)
+        }
+        if err := fn(element); err != nil {
+            return err
+        }
+    }
+    if _, err := decoder.Token(); err != nil {
+        return fmt.Errorf("decoding JSON stream: %w", err)
+    }
+    return nil
+}
+
+// BatchGET fetches endpoints with at most concurrency requests in flight.
+// Results and errors are indexed like endpoints.
+func (c *HTTPClient) BatchGET(endpoints []string, headers map[string]string, concurrency int) ([]*Response, []error) {
+    return c.BatchGETWithContext(context.Background(), endpoints, headers, concurrency)
+}
+
+// BatchGETWithContext is BatchGET where cancelling ctx abandons the remaining requests
+func (c *HTTPClient) BatchGETWithContext(ctx context.Context, endpoints []string, headers map[string]string, concurrency int) ([]*Response, []error) {
+    responses := make([]*Response, len(endpoints))
+    errs := make([]error, len(endpoints))
+    if concurrency <= 0 {
+        concurrency = 1
+    }
+
+    indexes := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < concurrency && w < len(endpoints); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range indexes {
+                if err := ctx.Err(); err != nil {
+                    errs[i] = fmt.Errorf("batch cancelled: %w", err)
+                    continue
+                }
+                responses[i], errs[i] = c.GETWithContext(ctx, endpoints[i], headers)
+            }
+        }()
+    }
+
+    for i := range endpoints {
+        indexes <- i
+    }
+    close(indexes)
+    wg.Wait()
+
+    return responses, errs
+}
+
+// GETWithContext performs a GET that is cancelled when ctx is done
+func (c *HTTPClient) GETWithContext(ctx context.Context, endpoint string, headers map[string]string) (*Response, error) {
+    return c.do(ctx, "GET", endpoint, nil, headers)
+}
+
+// POSTWithContext sends JSON data and is cancelled when ctx is done
+func (c *HTTPClient) POSTWithContext(ctx context.Context, endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(ctx, "POST", endpoint, data, headers)
+}
+
+// PUTWithContext replaces a resource and is cancelled when ctx is done
+func (c *HTTPClient) PUTWithContext(ctx context.Context, endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(ctx, "PUT", endpoint, data, headers)
+}
+
+// PATCHWithContext partially updates a resource and is cancelled when ctx is done
+func (c *HTTPClient) PATCHWithContext(ctx context.Context, endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(ctx, "PATCH", endpoint, data, headers)
+}
+
+// DELETEWithContext removes a resource and is cancelled when ctx is done
+func (c *HTTPClient) DELETEWithContext(ctx context.Context, endpoint string, data interface{}, headers map[string]string) (*Response, error) {
+    return c.do(ctx, "DELETE", endpoint, data, headers)
+}
+
+// RequestOptions overrides the client's retry settings for a single call.
+// Zero fields keep the client's values.
+type RequestOptions struct {
+    // MaxRetries, when non-nil, replaces the client's retry count; use Retries(0)
+    // to make a call that is never retried
+    MaxRetries *int
+    // RetryDelay, when positive, switches the call to linear backoff on this delay
+    RetryDelay time.Duration
+    // RetryableStatuses, when non-nil, replaces the set of statuses that are retried
+    RetryableStatuses []int
+}
+
+// Retries returns a pointer to n for RequestOptions.MaxRetries
+func Retries(n int) *int {
+    return &n
+}
+
+// requestOptionsKey is the context key for RequestOptions
+type requestOptionsKey struct{}
+
+// ContextWithRequestOptions returns a copy of ctx carrying opts, which the
+// *WithContext methods then apply to their call
+func ContextWithRequestOptions(ctx context.Context, opts RequestOptions) context.Context {
+    return context.WithValue(ctx, requestOptionsKey{}, opts)
+}
+
+// GETWithOptions performs a GET using opts in place of the client's retry settings
+func (c *HTTPClient) GETWithOptions(endpoint string, headers map[string]string, opts RequestOptions) (*Response, error) {
+    return c.GETWithContext(ContextWithRequestOptions(context.Background(), opts), endpoint, headers)
+}
+
+// POSTWithOptions sends JSON data using opts in place of the client's retry settings
+func (c *HTTPClient) POSTWithOptions(endpoint string, data interface{}, headers map[string]string, opts RequestOptions) (*Response, error) {
+    return c.POSTWithContext(ContextWithRequestOptions(context.Background(), opts), endpoint, data, headers)
+}
+
+// appendQuery adds encoded params to endpoint, respecting any existing query string
+func appendQuery(endpoint string, params url.Values) string {
+    if len(params) == 0 {
+        return endpoint
+    }
+
+    encoded := params.Encode()
+    switch {
+    case !strings.Contains(endpoint, "?"):
+        return endpoint + "?" + encoded
+    case strings.HasSuffix(endpoint, "?"), strings.HasSuffix(endpoint, "&"):
+        return endpoint + encoded
+    default:
+        return endpoint + "&" + encoded
+    }
+}
+
+// withHeader returns a copy of headers with key set to value
+func withHeader(headers map[string]string, key, value string) map[string]string {
+    out := make(map[string]string, len(headers)+1)
+    for k, v := range headers {
+        out[k] = v
+    }
+    out[key] = value
+    return out
+}
+
+// hasHeader reports whether headers sets key, ignoring case
+func hasHeader(headers map[string]string, key string) bool {
+    key = http.CanonicalHeaderKey(key)
+    for k := range headers {
+        if http.CanonicalHeaderKey(k) == key {
+            return true
+        }
+    }
+    return false
+}
+
+// newIdempotencyKey returns a random RFC 4122 version 4 UUID
+func newIdempotencyKey() (string, error) {
+    var b [16]byte
+    if _, err := cryptorand.Read(b[:]); err != nil {
+        return "", fmt.Errorf("generating idempotency key: %w", err)
+    }
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// resolveURL joins the base URL and endpoint with exactly one slash between them,
+// unless endpoint is already an absolute http:// or https:// URL, which is used
+// as-is so one client can follow links to other hosts
+func (c *HTTPClient) resolveURL(endpoint string) string {
+    lower := strings.ToLower(endpoint)
+    if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+        return endpoint
+    }
+    return joinURL(c.baseURL, endpoint)
+}
+
+// joinURL appends endpoint to base, collapsing or adding the slash at the seam.
+// An empty endpoint, or one that is only a query string, is appended unchanged.
+func joinURL(base, endpoint string) string {
+    if base == "" || endpoint == "" || strings.HasPrefix(endpoint, "?") {
+        return base + endpoint
+    }
+    return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(endpoint, "/")
+}
+
+// hostOf returns the host of rawURL, or "" if it cannot be parsed
+func hostOf(rawURL string) string {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return ""
+    }
+    return u.Host
+}
+
+// foreignHost reports whether u is on a different host than the base URL, treating an
+// omitted port as the scheme's default. It is false when there is no base host.
+func (c *HTTPClient) foreignHost(u *url.URL) bool {
+    base, err := url.Parse(c.baseURL)
+    if err != nil || base.Host == "" {
+        return false
+    }
+    return canonicalHost(u) != canonicalHost(base)
+}
+
+// canonicalHost returns u's lowercased host:port, filling in the default port for
+// http(s) and ws(s) URLs
+func canonicalHost(u *url.URL) string {
+    port := u.Port()
+    if port == "" {
+        switch u.Scheme {
+        case "http", "ws":
+            port = "80"
+        case "https", "wss":
+            port = "443"
+        }
+    }
+    return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// bodyFunc produces a fresh request body and its Content-Type for each attempt,
+// so retries never resend a partially consumed reader
+type bodyFunc func() (body io.Reader, contentType string, err error)
+
+// do sends a request whose body, if non-nil, is marshaled as JSON
+func (c *HTTPClient) do(ctx context.Context, method, endpoint string, body interface{}, headers map[string]string) (*Response, error) {
+    if body == nil {
+        return c.send(ctx, method, endpoint, nil, headers)
+    }
+
+    jsonData, err := json.Marshal(body)
+    if err != nil {
+        return nil, fmt.Errorf("marshaling data: %w", err)
+    }
+    jsonData, headers, err = c.compressBody(jsonData, headers)
+    if err != nil {
+        return nil, err
+    }
+
+    return c.send(ctx, method, endpoint, func() (io.Reader, string, error) {
+        return bytes.NewReader(jsonData), "application/json", nil
+    }, headers)
+}
+
+// compressBody gzips data once, ahead of the retry loop, when it reaches the
+// WithRequestCompression threshold and the caller hasn't set Content-Encoding.
+// Every attempt then resends the same compressed bytes.
+func (c *HTTPClient) compressBody(data []byte, headers map[string]string) ([]byte, map[string]string, error) {
+    if c.compressAbove <= 0 || len(data) < c.compressAbove || hasHeader(headers, "Content-Encoding") {
+        return data, headers, nil
+    }
+
+    var buf bytes.Buffer
+    writer := gzip.NewWriter(&buf)
+    if _, err := writer.Write(data); err != nil {
+        return nil, nil, fmt.Errorf("compressing request body: %w", err)
+    }
+    if err := writer.Close(); err != nil {
+        return nil, nil, fmt.Errorf("compressing request body: %w", err)
+    }
+    return buf.Bytes(), withHeader(headers, "Content-Encoding", "gzip"), nil
+}
+
+// send performs the request with retries and buffers the final response,
+// serving bodyless GETs from the response cache when one is configured
+func (c *HTTPClient) send(ctx context.Context, method, endpoint string, newBody bodyFunc, headers map[string]string) (*Response, error) {
+    cacheable := c.cache != nil && method == "GET" && newBody == nil
+    var reqHeader http.Header
+    if cacheable {
+        reqHeader = c.requestHeader(headers)
+        if cached, ok := c.cache.get(c.resolveURL(endpoint), reqHeader); ok {
+            return cached, nil
+        }
+    }
+
+    revalidating := false
+    if cacheable && reqHeader.Get("If-None-Match") == "" {
+        if etag, ok := c.cache.validator(c.resolveURL(endpoint), reqHeader); ok {
+            headers = withHeader(headers, "If-None-Match", etag)
+            revalidating = true
+        }
+    }
+
+    if c.autoDecompress && c.requestHeader(headers).Get("Accept-Encoding") == "" {
+        headers = withHeader(headers, "Accept-Encoding", "gzip, deflate")
+    }
+
+    if c.idempotencyKeys && method == "POST" && c.requestHeader(headers).Get("Idempotency-Key") == "" {
+        key, err := newIdempotencyKey()
+        if err != nil {
+            return nil, err
+        }
+        headers = withHeader(headers, "Idempotency-Key", key)
+    }
+
+    resp, attempts, err := c.countedRoundTrip(ctx, method, endpoint, newBody, headers)
+    if err != nil {
+        return nil, err
+    }
+    parsed, err := c.parseResponse(resp)
+    if err != nil {
+        return nil, &RequestError{Method: method, URL: c.resolveURL(endpoint), StatusCode: resp.StatusCode, Attempts: attempts, Err: err}
+    }
+
+    if revalidating && parsed.StatusCode == http.StatusNotModified {
+        if cached, ok := c.cache.revalidate(c.resolveURL(endpoint), reqHeader, parsed); ok {
+            return cached, nil
+        }
+    }
+
+    if cacheable {
+        c.cache.put(c.resolveURL(endpoint), reqHeader, parsed)
+    }
+    if c.errorResponse != nil && parsed.StatusCode >= 400 {
+        return parsed, c.apiError(method, endpoint, parsed, attempts)
+    }
+    return parsed, nil
+}
+
+// apiError builds the error returned for a 4xx or 5xx response under WithErrorResponse
+func (c *HTTPClient) apiError(method, endpoint string, resp *Response, attempts int) error {
+    reqErr := &RequestError{
+        Method:     method,
+        URL:        c.resolveURL(endpoint),
+        StatusCode: resp.StatusCode,
+        Attempts:   attempts,
+    }
+
+    value := c.errorResponse()
+    if err := json.Unmarshal(resp.Body, value); err != nil {
+        reqErr.Err = fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bodySnippet(resp.Body))
+        return reqErr
+    }
+    // Copied so the error stays valid after resp.Release recycles a pooled body
+    body := append([]byte(nil), resp.Body...)
+    reqErr.Err = &APIError{StatusCode: resp.StatusCode, Body: body, Value: value}
+    return reqErr
+}
+
+// roundTrip sends the request with retries, tracing the overall call when enabled.
+// The caller must close the returned response body.
+func (c *HTTPClient) roundTrip(ctx context.Context, method, endpoint string, newBody bodyFunc, headers map[string]string) (*http.Response, error) {
+    resp, _, err := c.countedRoundTrip(ctx, method, endpoint, newBody, headers)
+    return resp, err
+}
+
+// countedRoundTrip is roundTrip that also reports how many attempts were sent
+func (c *HTTPClient) countedRoundTrip(ctx context.Context, method, endpoint string, newBody bodyFunc, headers map[string]string) (*http.Response, int, error) {
+    if c.configErr != nil {
+        return nil, 0, &RequestError{Method: method, URL: c.resolveURL(endpoint), Err: c.configErr}
+    }
+
+    finish := func(*http.Response, int, error) {}
+    if c.tracer != nil {
+        ctx, finish = c.tracer.start(ctx, method, c.resolveURL(endpoint))
+    }
+
+    start := time.Now()
+    resp, attempts, err := c.retryLoop(ctx, method, endpoint, newBody, headers)
+    status := 0
+    if resp != nil {
+        status = resp.StatusCode
+    }
+    c.metrics.ObserveRequest(method, hostOf(c.resolveURL(endpoint)), status, time.Since(start))
+
+    if err != nil {
+        err = &RequestError{Method: method, URL: c.resolveURL(endpoint), Attempts: attempts, Err: err}
+    }
+    finish(resp, attempts, err)
+    return resp, attempts, err
+}
+
+// retryLoop builds and sends a request, retrying on network errors and retryable statuses.
+// newBody is called once per attempt; nil sends no payload. It also reports how many
+// attempts were sent.
+func (c *HTTPClient) retryLoop(ctx context.Context, method, endpoint string, newBody bodyFunc, headers map[string]string) (*http.Response, int, error) {
+    url := c.resolveURL(endpoint)
+    host := hostOf(url)
+    attempts := 0
+    policy := c.retryPolicy(ctx)
+
+    for attempt := 0; attempt <= policy.maxRetries; attempt++ {
+        if attempt > 0 {
+            c.metrics.ObserveRetry(method, host)
+        }
+        if c.limiter != nil && (attempt == 0 || c.limitRetries) {
+            if err := c.limiter.Wait(ctx); err != nil {
+                return nil, attempts, fmt.Errorf("waiting for rate limiter: %w", err)
+            }
+        }
+
+        var reqBody io.Reader
+        var contentType string
+        if newBody != nil {
+            var err error
+            reqBody, contentType, err = newBody()
+            if err != nil {
+                return nil, attempts, fmt.Errorf("building request body: %w", err)
+            }
+        }
+
+        req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+        if err != nil {
+            // Streaming bodies such as multipart feed a pipe from a goroutine; closing
+            // the reader releases it
+            if closer, ok := reqBody.(io.Closer); ok {
+                closer.Close()
+            }
+            return nil, attempts, fmt.Errorf("creating request: %w", err)
+        }
+
+        if contentType != "" {
+            req.Header.Set("Content-Type", contentType)
+        }
+        c.applyHeaders(req, headers)
+        if tmpl, ok := ctx.Value(requestTemplateKey{}).(*http.Request); ok {
+            applyTemplate(req, tmpl)
+        }
+        if c.tracer != nil {
+            c.tracer.inject(ctx, req.Header)
+        }
+        if c.signer != nil {
+            if err := c.sign(req); err != nil {
+                if req.Body != nil {
+                    req.Body.Close()
+                }
+                return nil, attempts, err
+            }
+        }
+
+        if c.breaker != nil {
+            if err := c.breaker.allow(); err != nil {
+                if req.Body != nil {
+                    req.Body.Close()
+                }
+                return nil, attempts, err
+            }
+        }
+
+        c.mu.RLock()
+        requestHooks, responseHooks := c.requestHooks, c.responseHooks
+        c.mu.RUnlock()
+
+        for _, hook := range requestHooks {
+            hook(req, attempt)
+        }
+        start := time.Now()
+        attempts++
+        resp, err := c.client.Do(req)
+        latency := time.Since(start)
+        for _, hook := range responseHooks {
+            hook(resp, err, attempt, latency)
+        }
+        slow := c.onSlow != nil && latency > c.slowThreshold
+        c.stats.record(host, latency, err != nil, slow)
+        if slow {
+            c.onSlow(req, latency)
+        }
+
+        if c.breaker != nil {
+            c.breaker.record(err == nil && resp.StatusCode < 500)
+        }
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, attempts, fmt.Errorf("request cancelled: %w", ctx.Err())
+            }
+            retryable := !errors.Is(err, ErrHTTP2Required) && (c.retryPredicate == nil || c.retryPredicate(nil, err))
+            if attempt < policy.maxRetries && retryable {
+                delay := policy.delay(attempt)
+                c.logger.Infof("retrying %s %s after attempt %d failed: %v (waiting %s)", method, url, attempt+1, err, delay)
+                if err := c.wait(ctx, delay); err != nil {
+                    return nil, attempts, err
+                }
+                continue
+            }
+            c.logger.Warnf("%s %s failed after %d attempts: %v", method, url, attempts, err)
+            return nil, attempts, fmt.Errorf("request failed after %d attempts: %w", attempts, err)
+        }
+
+        retry := policy.retryable(resp.StatusCode)
+        if c.retryPredicate != nil && attempt < policy.maxRetries {
+            if retry, err = c.checkRetryPredicate(resp); err != nil {
+                return nil, attempts, err
+            }
+        }
+        if retry && attempt < policy.maxRetries {
+            delay := policy.delay(attempt)
+            if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+                if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && retryAfter > delay {
+                    delay = retryAfter
+                    if c.maxRetryAfter > 0 && delay > c.maxRetryAfter {
+                        delay = c.maxRetryAfter
+                    }
+                }
+            }
+            drainAndClose(resp)
+            c.logger.Infof("retrying %s %s after attempt %d returned status %d (waiting %s)", method, url, attempt+1, resp.StatusCode, delay)
+            if err := c.wait(ctx, delay); err != nil {
+                return nil, attempts, err
+            }
+            continue
+        }
+
+        if attempt > 0 {
+            c.logger.Debugf("%s %s finished with status %d after %d attempts", method, url, resp.StatusCode, attempts)
+        }
+        return resp, attempts, nil
+    }
+
+    return nil, attempts, fmt.Errorf("max retries exceeded")
+}
+
+// maxDrainBytes caps how much of an abandoned body drainAndClose reads; past this,
+// closing the connection is cheaper than reading on to reuse it
+const maxDrainBytes = 64 << 10
+
+// drainAndClose reads what is left of resp's body, up to maxDrainBytes, and closes
+// it so the keep-alive connection can go back to the pool
+func drainAndClose(resp *http.Response) {
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+    resp.Body.Close()
+}
+
+// checkRetryPredicate buffers resp's body so the retry predicate can inspect the
+// parsed response, then restores it so the caller can still read it
+func (c *HTTPClient) checkRetryPredicate(resp *http.Response) (bool, error) {
+    parsed, err := c.parseResponse(resp)
+    if err != nil {
+        return false, err
+    }
+    // parseResponse dropped Content-Encoding if it decoded the body, so the
+    // restored bytes are read as-is later
+    resp.Body = ioutil.NopCloser(bytes.NewReader(parsed.Body))
+    resp.ContentLength = int64(len(parsed.Body))
+    return c.retryPredicate(parsed, nil), nil
+}
+
+// sign runs the request signer. Signers need the exact bytes being sent, so the
+// attempt's body is buffered once and served both to req.GetBody and, afresh, as
+// the body sent afterwards.
+func (c *HTTPClient) sign(req *http.Request) error {
+    buffered := req.Body != nil && req.Body != http.NoBody
+    if buffered {
+        data, err := ioutil.ReadAll(req.Body)
+        req.Body.Close()
+        if err != nil {
+            return fmt.Errorf("building request body: %w", err)
+        }
+        req.ContentLength = int64(len(data))
+        req.GetBody = func() (io.ReadCloser, error) {
+            return ioutil.NopCloser(bytes.NewReader(data)), nil
+        }
+        req.Body, _ = req.GetBody()
+    }
+
+    if err := c.signer(req); err != nil {
+        return fmt.Errorf("signing request: %w", err)
+    }
+
+    if buffered {
+        req.Body, _ = req.GetBody()
+    }
+    return nil
+}
+
+// retryPolicy is the retry behavior for one call: the client's settings with any
+// RequestOptions from the context applied on top
+type retryPolicy struct {
+    maxRetries    int
+    backoff       BackoffStrategy
+    retryStatuses map[int]bool
+}
+
+// retryPolicy resolves the retry behavior for a call made with ctx
+func (c *HTTPClient) retryPolicy(ctx context.Context) retryPolicy {
+    policy := retryPolicy{
+        maxRetries:    c.maxRetries,
+        backoff:       c.backoff,
+        retryStatuses: c.retryStatuses,
+    }
+    if policy.backoff == nil {
+        policy.backoff = LinearBackoff{Delay: c.retryDelay}
+    }
+
+    opts, ok := ctx.Value(requestOptionsKey{}).(RequestOptions)
+    if !ok {
+        return policy
+    }
+    if opts.MaxRetries != nil {
+        policy.maxRetries = *opts.MaxRetries
+        if policy.maxRetries < 0 {
+            policy.maxRetries = 0
+        }
+    }
+    if opts.RetryDelay > 0 {
+        policy.backoff = LinearBackoff{Delay: opts.RetryDelay}
+    }
+    if opts.RetryableStatuses != nil {
+        policy.retryStatuses = make(map[int]bool, len(opts.RetryableStatuses))
+        for _, code := range opts.RetryableStatuses {
+            policy.retryStatuses[code] = true
+        }
+    }
+    return policy
+}
+
+// retryable reports whether a response with this status should be retried
+func (p retryPolicy) retryable(code int) bool {
+    if p.retryStatuses != nil {
+        return p.retryStatuses[code]
+    }
+    return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// delay returns the backoff before the given retry
+func (p retryPolicy) delay(attempt int) time.Duration {
+    return p.backoff.NextDelay(attempt)
+}
+
+// parseRetryAfter reads a Retry-After value in either delay-seconds or HTTP-date form
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return 0, false
+    }
+
+    if seconds, err := strconv.Atoi(value); err == nil {
+        if seconds < 0 {
+            return 0, false
+        }
+        return time.Duration(seconds) * time.Second, true
+    }
+
+    if date, err := http.ParseTime(value); err == nil {
+        delay := date.Sub(now)
+        if delay < 0 {
+            delay = 0
+        }
+        return delay, true
+    }
+
+    return 0, false
+}
+
+// wait sleeps for the retry delay, returning early if ctx is cancelled
+func (c *HTTPClient) wait(ctx context.Context, delay time.Duration) error {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+    case <-ctx.Done():
+        return fmt.Errorf("retry aborted: %w", ctx.Err())
+    case <-timer.C:
+        return nil
+    }
+}
+
+// Response represents an HTTP response
+type Response struct {
+    StatusCode  int
+    Body        []byte
+    Headers     http.Header
+    FromCache   bool   // served from the client's response cache
+    NotModified bool   // cached body returned after a 304 revalidation
+    Proto       string // protocol the response arrived over, e.g. "HTTP/1.1" or "HTTP/2.0"
+    // Redirects lists the redirects followed to reach this response, in order;
+    // it is empty when the first request was answered directly
+    Redirects []RedirectHop
+
+    pool *sync.Pool    // where buf goes on Release
+    buf  *bytes.Buffer // pooled buffer backing Body, if any
+}
+
+// RedirectHop is one redirect a request followed
+type RedirectHop struct {
+    URL        string // URL that answered with the redirect
+    StatusCode int    // its 3xx status
+    Location   string // where it pointed
+}
+
+// IsSuccess reports whether the response has a 2xx status code
+func (r *Response) IsSuccess() bool {
+    return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// JSON unmarshals the response body into v
+func (r *Response) JSON(v interface{}) error {
+    if err := json.Unmarshal(r.Body, v); err != nil {
+        return fmt.Errorf("decoding JSON response (status %d, body %q): %w", r.StatusCode, bodySnippet(r.Body), err)
+    }
+    return nil
+}
+
+// XML unmarshals the response body into v
+func (r *Response) XML(v interface{}) error {
+    if err := xml.Unmarshal(r.Body, v); err != nil {
+        return fmt.Errorf("decoding XML response (status %d, body %q): %w", r.StatusCode, bodySnippet(r.Body), err)
+    }
+    return nil
+}
+
+// maxPooledBuffer is the largest buffer Release returns to the pool, so one huge
+// response doesn't pin its memory for the life of the client
+const maxPooledBuffer = 1 << 20
+
+// Release hands Body's buffer back to the pool set up by WithBufferPool and clears
+// Body, which must not be used afterwards; slices of it that were kept must be
+// copied first. Errors and cache entries hold their own copies. It is a no-op for
+// other responses.
+func (r *Response) Release() {
+    if r.buf == nil {
+        return
+    }
+    if r.buf.Cap() <= maxPooledBuffer {
+        r.pool.Put(r.buf)
+    }
+    r.buf, r.pool, r.Body = nil, nil, nil
+}
+
+// String returns the body as a string
+func (r *Response) String() string {
+    return string(r.Body)
+}
+
+// Header returns the first value of the named header, matched case-insensitively
+func (r *Response) Header(name string) string {
+    return r.Headers.Get(name)
+}
+
+// ContentType returns the media type from Content-Type without parameters, lowercased
+func (r *Response) ContentType() string {
+    value := r.Headers.Get("Content-Type")
+    if value == "" {
+        return ""
+    }
+    mediaType, _, err := mime.ParseMediaType(value)
+    if err != nil {
+        return strings.ToLower(strings.TrimSpace(strings.Split(value, ";")[0]))
+    }
+    return mediaType
+}
+
+// IsJSON reports whether the content type is application/json or a +json type
+func (r *Response) IsJSON() bool {
+    mediaType := r.ContentType()
+    return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// IsXML reports whether the content type is application/xml, text/xml or a +xml type
+func (r *Response) IsXML() bool {
+    mediaType := r.ContentType()
+    return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// ErrUnsupportedContentType is returned by Decode for bodies it cannot parse
+var ErrUnsupportedContentType = errors.New("unsupported response content type")
+
+// Decode unmarshals the body into v according to Content-Type: JSON for
+// application/json and +json types, XML for application/xml, text/xml and +xml
+// types. Parameters such as charset are ignored when matching. Any other type,
+// or none, fails with ErrUnsupportedContentType.
+func (r *Response) Decode(v interface{}) error {
+    switch {
+    case r.IsJSON():
+        return r.JSON(v)
+    case r.IsXML():
+        return r.XML(v)
+    default:
+        return fmt.Errorf("%w %q", ErrUnsupportedContentType, r.Headers.Get("Content-Type"))
+    }
+}
+
+// bodySnippet returns the start of a body for use in error messages
+func bodySnippet(body []byte) string {
+    const maxSnippet = 200
+    if len(body) > maxSnippet {
+        return string(body[:maxSnippet]) + "..."
+    }
+    return string(body)
+}
+
+// parseResponse reads and parses the HTTP response
+func (c *HTTPClient) parseResponse(resp *http.Response) (*Response, error) {
+    defer drainAndClose(resp)
+
+    var body []byte
+    var buf *bytes.Buffer
+    if c.bufferPool != nil {
+        buf = c.bufferPool.Get().(*bytes.Buffer)
+        buf.Reset()
+        if err := readLimitedInto(buf, resp.Body, c.maxResponseSize); err != nil {
+            c.bufferPool.Put(buf)
+            return nil, fmt.Errorf("reading response body: %w", err)
+        }
+        body = buf.Bytes()
+    } else {
+        var err error
+        body, err = readLimited(resp.Body, c.maxResponseSize)
+        if err != nil {
+            return nil, fmt.Errorf("reading response body: %w", err)
+        }
+    }
+
+    // HEAD and 204 responses carry encoding headers but no body to decode
+    if c.autoDecompress && len(body) > 0 {
+        if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+            decoded, ok, err := decodeBody(encoding, body, c.maxResponseSize)
+            if err != nil {
+                if buf != nil {
+                    c.bufferPool.Put(buf)
+                }
+                return nil, fmt.Errorf("decoding %s response body: %w", encoding, err)
+            }
+            if ok {
+                if buf != nil {
+                    // The decoded copy replaces the pooled bytes
+                    c.bufferPool.Put(buf)
+                    buf = nil
+                }
+                body = decoded
+                resp.Header.Del("Content-Encoding")
+                resp.Header.Del("Content-Length")
+            }
+        }
+    }
+
+    return &Response{
+        StatusCode: resp.StatusCode,
+        Body:       body,
+        Headers:    resp.Header,
+        Proto:      resp.Proto,
+        Redirects:  redirectChain(resp),
+        pool:       c.bufferPool,
+        buf:        buf,
+    }, nil
+}
+
+// redirectChain walks back from the final response through the redirect responses
+// net/http links to each follow-up request
+func redirectChain(resp *http.Response) []RedirectHop {
+    var hops []RedirectHop
+    for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+        redirect := req.Response
+        hop := RedirectHop{StatusCode: redirect.StatusCode, Location: req.URL.String()}
+        if redirect.Request != nil {
+            hop.URL = redirect.Request.URL.String()
+        }
+        hops = append(hops, hop)
+    }
+    for i, j := 0, len(hops)-1; i < j; i, j = i+1, j-1 {
+        hops[i], hops[j] = hops[j], hops[i]
+    }
+    return hops
+}
+
+// decodeBody decompresses a gzip or deflate body; ok is false for other encodings
+func decodeBody(encoding string, body []byte, limit int64) (decoded []byte, ok bool, err error) {
+    var reader io.ReadCloser
+    switch strings.ToLower(strings.TrimSpace(encoding)) {
+    case "gzip", "x-gzip":
+        reader, err = gzip.NewReader(bytes.NewReader(body))
+        if err != nil {
+            return nil, false, err
+        }
+    case "deflate":
+        // "deflate" is meant to be zlib-wrapped, but some servers send raw DEFLATE
+        reader, err = zlib.NewReader(bytes.NewReader(body))
+        if err != nil {
+            reader = flate.NewReader(bytes.NewReader(body))
+        }
+    default:
+        return nil, false, nil
+    }
+    defer reader.Close()
+
+    decoded, err = readLimited(reader, limit)
+    if err != nil {
+        return nil, false, err
+    }
+    return decoded, true, nil
+}
+
+// ErrResponseTooLarge is returned when a body exceeds WithMaxResponseSize
+var ErrResponseTooLarge = errors.New("response body exceeds size limit")
+
+// readLimited reads all of r, failing with ErrResponseTooLarge past limit bytes; limit <= 0 means no limit
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+    if limit <= 0 {
+        return ioutil.ReadAll(r)
+    }
+
+    body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(body)) > limit {
+        return nil, fmt.Errorf("%w (%d bytes)", ErrResponseTooLarge, limit)
+    }
+    return body, nil
+}
+
+// readLimitedInto is readLimited reading into buf
+func readLimitedInto(buf *bytes.Buffer, r io.Reader, limit int64) error {
+    if limit <= 0 {
+        _, err := buf.ReadFrom(r)
+        return err
+    }
+
+    if _, err := buf.ReadFrom(io.LimitReader(r, limit+1)); err != nil {
+        return err
+    }
+    if int64(buf.Len()) > limit {
+        return fmt.Errorf("%w (%d bytes)", ErrResponseTooLarge, limit)
+    }
+    return nil
+}
+
+// RequestError describes a failed call so callers can react to its category
+type RequestError struct {
+    Method     string
+    URL        string
+    Attempts   int // attempts actually sent; 0 if the call failed before sending
+    StatusCode int // final HTTP status, or 0 if no response was received
+    Err        error
+}
+
+// Error implements the error interface
+func (e *RequestError) Error() string {
+    return fmt.Sprintf("%s %s: %v", e.Method, e.URL, e.Err)
+}
+
+// Unwrap exposes the underlying error to errors.Is and errors.As
+func (e *RequestError) Unwrap() error {
+    return e.Err
+}
+
+// IsTimeout reports whether the call failed because a deadline or timeout expired
+func (e *RequestError) IsTimeout() bool {
+    if errors.Is(e.Err, context.DeadlineExceeded) {
+        return true
+    }
+    var netErr net.Error
+    return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// IsConnectionError reports whether the call failed to reach the server,
+// e.g. DNS failure, refused or reset connection
+func (e *RequestError) IsConnectionError() bool {
+    if e.IsTimeout() {
+        return false
+    }
+    var opErr *net.OpError
+    var dnsErr *net.DNSError
+    return errors.As(e.Err, &opErr) || errors.As(e.Err, &dnsErr) ||
+        errors.Is(e.Err, io.EOF) || errors.Is(e.Err, io.ErrUnexpectedEOF)
+}
+
+// IsRetriable reports whether trying again, possibly against another endpoint, may succeed
+func (e *RequestError) IsRetriable() bool {
+    if errors.Is(e.Err, context.Canceled) {
+        return false
+    }
+    if e.IsTimeout() || e.IsConnectionError() || errors.Is(e.Err, ErrCircuitOpen) {
+        return true
+    }
+    return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// APIError carries the error body a server returned, decoded into the type
+// registered with WithErrorResponse
+type APIError struct {
+    StatusCode int
+    Body       []byte
+    Value      interface{} // the value returned by WithErrorResponse's constructor, filled in
+}
+
+// Error implements error
+func (e *APIError) Error() string {
+    return fmt.Sprintf("API error (status %d): %s", e.StatusCode, bodySnippet(e.Body))
+}
+
+// ErrCircuitOpen is returned without sending a request while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitState is the breaker's current mode
+type circuitState int
+
+const (
+    circuitClosed circuitState = iota
+    circuitOpen
+    circuitHalfOpen
+)
+
+// circuitBreaker stops traffic to a failing upstream and lets a single probe through
+// after the cooldown to test whether it has recovered
+type circuitBreaker struct {
+    threshold int
+    cooldown  time.Duration
+    window    time.Duration // zero counts failures without a time limit
+
+    mu       sync.Mutex
+    state    circuitState
+    failures int
+    firstAt  time.Time // when the current run of failures began
+    openedAt time.Time
+    probing  bool
+}
+
+// allow reports whether a request may be sent now
+func (b *circuitBreaker) allow() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case circuitOpen:
+        if time.Since(b.openedAt) < b.cooldown {
+            return ErrCircuitOpen
+        }
+        b.state = circuitHalfOpen
+        b.probing = true
+        return nil
+    case circuitHalfOpen:
+        if b.probing {
+            return ErrCircuitOpen
+        }
+        b.probing = true
+        return nil
+    default:
+        return nil
+    }
+}
+
+// record updates the breaker with the outcome of an attempt
+func (b *circuitBreaker) record(success bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if success {
+        b.state = circuitClosed
+        b.failures = 0
+        b.probing = false
+        return
+    }
+
+    now := time.Now()
+    if b.window > 0 && b.failures > 0 && now.Sub(b.firstAt) > b.window {
+        b.failures = 0
+    }
+    if b.failures == 0 {
+        b.firstAt = now
+    }
+    b.failures++
+    if b.state == circuitHalfOpen || b.failures >= b.threshold {
+        b.state = circuitOpen
+        b.openedAt = now
+        b.probing = false
+    }
+}
+
+// defaultDialTimeout bounds the websocket handshake when no timeout is configured
+const defaultDialTimeout = 10 * time.Second
+
+// defaultMaxReconnects limits redial attempts after a dropped connection
+const defaultMaxReconnects = 5
+
+// errWebSocketClosed is returned once Close has been called
+var errWebSocketClosed = errors.New("websocket closed")
+
+// defaultWriteTimeout bounds each websocket send when no timeout is configured
+const defaultWriteTimeout = 10 * time.Second
+
+// DefaultReadLimit caps incoming websocket messages when WithReadLimit is not used
+const DefaultReadLimit = 16 << 20
+
+// defaultMessageBuffer is the Messages channel capacity when none is configured
+const defaultMessageBuffer = 64
+
+// WSMessage is a frame delivered on the Messages channel
+type WSMessage struct {
+    Type int // websocket.TextMessage or websocket.BinaryMessage
+    Data []byte
+}
+
+// WSState is a stage in a WebSocketConnection's lifecycle
+type WSState int
+
+const (
+    WSDisconnected WSState = iota // not connected, and not trying to be
+    WSConnecting                  // Connect is performing the first handshake
+    WSConnected                   // a connection is open
+    WSReconnecting                // redialing after the connection dropped
+    WSClosed                      // Close was called
+)
+
+// String returns the state's name
+func (s WSState) String() string {
+    switch s {
+    case WSDisconnected:
+        return "disconnected"
+    case WSConnecting:
+        return "connecting"
+    case WSConnected:
+        return "connected"
+    case WSReconnecting:
+        return "reconnecting"
+    case WSClosed:
+        return "closed"
+    default:
+        return fmt.Sprintf("WSState(%d)", int(s))
+    }
+}
+
+// WebSocketConnection manages websocket connections. It is safe for concurrent
+// use: all writes, including keepalive pings and close frames, go through one
+// lock, and reads through another, as gorilla/websocket requires.
+type WebSocketConnection struct {
+    url              string
+    isConnected      bool
+    reconnect        bool
+    dialTimeout      time.Duration
+    headers          http.Header
+    maxReconnects    int
+    pingInterval     time.Duration
+    pongTimeout      time.Duration
+    onReconnect      func()
+    closed           bool
+    done             chan struct{}
+    conn             *websocket.Conn
+    messageBuffer    int
+    dropOnFull       bool
+    messages         chan WSMessage
+    errs             chan error
+    pumpStarted      bool          // a reader is running for messages and errs
+    closeAck         chan struct{} // closed when the peer sends its close frame
+    writeTimeout     time.Duration
+    compression      bool
+    compressionLevel int
+    state            WSState
+    onConnect        func()
+    onDisconnect     func(error)
+    onStateChange    func(oldState, newState WSState)
+    subprotocols     []string
+    readLimit        int64
+    mu               sync.Mutex // guards conn, isConnected, state, closed, done and callbacks
+    readMu           sync.Mutex // gorilla allows one concurrent reader
+    writeMu          sync.Mutex // gorilla allows one concurrent writer
+    reconnectMu      sync.Mutex // serializes redials triggered by readers and writers
+}
+
+// WSOption configures a WebSocketConnection at construction time
+type WSOption func(*WebSocketConnection)
+
+// WithReconnect enables or disables automatic redialing after a dropped connection
+func WithReconnect(enabled bool) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.reconnect = enabled
+    }
+}
+
+// WithMaxReconnects limits how many redial attempts are made per dropped connection
+func WithMaxReconnects(n int) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.maxReconnects = n
+    }
+}
+
+// WithDialTimeout bounds the websocket handshake
+func WithDialTimeout(d time.Duration) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.dialTimeout = d
+    }
+}
+
+// WithWriteTimeout fails a send that cannot be written within d, e.g. because the
+// peer stopped reading, with an error whose Timeout method reports true. The
+// failed connection is dropped and, with reconnect enabled, redialed. Zero lets
+// writes block indefinitely. Reads are bounded separately by the ping keepalive.
+func WithWriteTimeout(d time.Duration) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.writeTimeout = d
+    }
+}
+
+// WithReadLimit caps the size of an incoming message at n bytes as sent on the wire.
+// A larger message fails the read with an error wrapping websocket.ErrReadLimit, and
+// the connection is closed with status 1009 (message too big) as soon as a frame
+// header announces the excess, before its payload is buffered. Zero removes the
+// limit, which lets a misbehaving server exhaust memory.
+func WithReadLimit(n int64) WSOption {
+    if n < 0 {
+        panic(fmt.Sprintf("WithReadLimit: limit must be non-negative, got %d", n))
+    }
+    return func(ws *WebSocketConnection) {
+        ws.readLimit = n
+    }
+}
+
+// WithCompression negotiates permessage-deflate (RFC 7692) during the handshake and
+// compresses outgoing messages when the server accepts it; if it doesn't, messages
+// are sent uncompressed. Compression trades CPU on both ends for bandwidth, which
+// pays off for large or repetitive text such as JSON but not for small or already
+// compressed payloads.
+func WithCompression(enabled bool) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.compression = enabled
+    }
+}
+
+// WithCompressionLevel sets the deflate level used with WithCompression, from
+// flate.HuffmanOnly (-2) to flate.BestCompression (9); the default is flate.BestSpeed.
+// It panics if level is out of range.
+func WithCompressionLevel(level int) WSOption {
+    if level < flate.HuffmanOnly || level > flate.BestCompression {
+        panic(fmt.Sprintf("WithCompressionLevel: level must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, level))
+    }
+    return func(ws *WebSocketConnection) {
+        ws.compressionLevel = level
+    }
+}
+
+// WithSubprotocols offers protocols, in order of preference, in the handshake's
+// Sec-WebSocket-Protocol header. Connect fails if the server doesn't select one.
+func WithSubprotocols(protocols ...string) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.subprotocols = protocols
+    }
+}
+
+// WithPingInterval sends a ping frame every d to keep the connection alive
+// and detect a peer that has gone away
+func WithPingInterval(d time.Duration) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.pingInterval = d
+    }
+}
+
+// WithPongTimeout sets how long to wait for a pong before the connection is considered dead.
+// It defaults to the ping interval.
+func WithPongTimeout(d time.Duration) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.pongTimeout = d
+    }
+}
+
+// WithMessageBuffer sets the capacity of the Messages channel
+func WithMessageBuffer(n int) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.messageBuffer = n
+    }
+}
+
+// WithDropOnFull discards incoming messages while the Messages channel is full
+// instead of blocking the reader until the consumer catches up
+func WithDropOnFull(drop bool) WSOption {
+    return func(ws *WebSocketConnection) {
+        ws.dropOnFull = drop
+    }
+}
+
+// NewWebSocketConnection creates a websocket connection for url; call Connect to dial it
+func NewWebSocketConnection(url string, opts ...WSOption) *WebSocketConnection {
+    ws := &WebSocketConnection{
+        url:              url,
+        dialTimeout:      defaultDialTimeout,
+        writeTimeout:     defaultWriteTimeout,
+        readLimit:        DefaultReadLimit,
+        compressionLevel: flate.BestSpeed,
+        maxReconnects:    defaultMaxReconnects,
+        messageBuffer:    defaultMessageBuffer,
+    }
+
+    for _, opt := range opts {
+        opt(ws)
+    }
+
+    return ws
+}
+
+// Connect establishes a websocket connection
+func (ws *WebSocketConnection) Connect() error {
+    return ws.ConnectWithHeaders(nil)
+}
+
+// ConnectWithHeaders dials the websocket, sending headers (e.g. auth tokens) with the handshake.
+// The same headers are reused when reconnecting.
+func (ws *WebSocketConnection) ConnectWithHeaders(headers http.Header) error {
+    ws.mu.Lock()
+    ws.headers = headers
+    ws.closed = false
+    ws.done = make(chan struct{})
+    ws.detachPumpLocked()
+    notify := ws.transition(WSConnecting, nil)
+    ws.mu.Unlock()
+    notify()
+
+    if err := ws.dial(headers); err != nil {
+        ws.mu.Lock()
+        notify := func() {}
+        if !ws.closed {
+            notify = ws.transition(WSDisconnected, err)
+        }
+        ws.mu.Unlock()
+        notify()
+        return err
+    }
+    return nil
+}
+
+// dial performs the handshake and installs the resulting connection
+func (ws *WebSocketConnection) dial(headers http.Header) error {
+    timeout := ws.dialTimeout
+    if timeout <= 0 {
+        timeout = defaultDialTimeout
+    }
+    dialer := websocket.Dialer{
+        Proxy:             http.ProxyFromEnvironment,
+        HandshakeTimeout:  timeout,
+        EnableCompression: ws.compression,
+        Subprotocols:      ws.subprotocols,
+    }
+
+    conn, resp, err := dialer.Dial(ws.url, headers)
+    if err != nil {
+        if resp != nil {
+            return fmt.Errorf("websocket handshake failed with status %d: %w", resp.StatusCode, err)
+        }
+        return fmt.Errorf("dialing websocket: %w", err)
+    }
+
+    if len(ws.subprotocols) > 0 && !containsString(ws.subprotocols, conn.Subprotocol()) {
+        selected := conn.Subprotocol()
+        conn.Close()
+        if selected == "" {
+            return fmt.Errorf("websocket server selected none of the subprotocols %q", ws.subprotocols)
+        }
+        return fmt.Errorf("websocket server selected unrequested subprotocol %q", selected)
+    }
+
+    conn.SetReadLimit(ws.readLimit)
+
+    if ws.compression {
+        // Both are no-ops unless the server agreed to permessage-deflate
+        conn.EnableWriteCompression(true)
+        if err := conn.SetCompressionLevel(ws.compressionLevel); err != nil {
+            conn.Close()
+            return fmt.Errorf("setting websocket compression level: %w", err)
+        }
+    }
+
+    closeAck := make(chan struct{})
+    var ackOnce sync.Once
+    conn.SetCloseHandler(func(code int, text string) error {
+        ackOnce.Do(func() { close(closeAck) })
+        ws.markDisconnected(conn, &websocket.CloseError{Code: code, Text: text})
+        message := websocket.FormatCloseMessage(code, "")
+        ws.writeControl(conn, websocket.CloseMessage, message, time.Now().Add(time.Second))
+        return nil
+    })
+
+    ws.mu.Lock()
+    if ws.closed {
+        ws.mu.Unlock()
+        conn.Close()
+        return errWebSocketClosed
+    }
+    ws.conn = conn
+    ws.closeAck = closeAck
+    ws.isConnected = true
+    done := ws.done
+    ws.startPumpLocked()
+    notify := ws.transition(WSConnected, nil)
+    ws.mu.Unlock()
+    notify()
+
+    if ws.pingInterval > 0 {
+        ws.startKeepalive(conn, done)
+    }
+    return nil
+}
+
+// startKeepalive pings conn periodically and extends the read deadline on each pong.
+// Pongs are processed by ReadMessage, so a missing pong surfaces as a read timeout
+// that marks the connection dead.
+func (ws *WebSocketConnection) startKeepalive(conn *websocket.Conn, done chan struct{}) {
+    pongTimeout := ws.pongTimeout
+    if pongTimeout <= 0 {
+        pongTimeout = ws.pingInterval
+    }
+    deadAfter := ws.pingInterval + pongTimeout
+
+    conn.SetReadDeadline(time.Now().Add(deadAfter))
+    conn.SetPongHandler(func(string) error {
+        return conn.SetReadDeadline(time.Now().Add(deadAfter))
+    })
+
+    go func() {
+        ticker := time.NewTicker(ws.pingInterval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+
+            if err := ws.writeControl(conn, websocket.PingMessage, nil, time.Now().Add(pongTimeout)); err != nil {
+                // Once Close has sent its close frame pings fail; leave the
+                // connection up so the closing handshake can finish
+                if ws.isClosed() {
+                    return
+                }
+                ws.markDisconnected(conn, fmt.Errorf("sending websocket ping: %w", err))
+                conn.Close()
+                return
+            }
+        }
+    }()
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// OnReconnect registers a callback invoked after each successful automatic reconnect,
+// e.g. to re-subscribe to channels
+func (ws *WebSocketConnection) OnReconnect(fn func()) {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.onReconnect = fn
+}
+
+// OnConnect registers a callback invoked each time a connection opens, including
+// after a reconnect
+func (ws *WebSocketConnection) OnConnect(fn func()) {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.onConnect = fn
+}
+
+// OnDisconnect registers a callback invoked when an open connection goes away, with
+// the error that ended it, or nil when Close ended it
+func (ws *WebSocketConnection) OnDisconnect(fn func(err error)) {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.onDisconnect = fn
+}
+
+// OnStateChange registers a callback invoked on every lifecycle transition
+func (ws *WebSocketConnection) OnStateChange(fn func(oldState, newState WSState)) {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.onStateChange = fn
+}
+
+// State returns the connection's current lifecycle state
+func (ws *WebSocketConnection) State() WSState {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    return ws.state
+}
+
+// transition moves to state and returns a function that runs the matching callbacks.
+// ws.mu must be held; call the returned function after releasing it.
+func (ws *WebSocketConnection) transition(state WSState, cause error) func() {
+    old := ws.state
+    if old == state {
+        return func() {}
+    }
+    ws.state = state
+    onStateChange, onConnect, onDisconnect := ws.onStateChange, ws.onConnect, ws.onDisconnect
+
+    return func() {
+        if onStateChange != nil {
+            onStateChange(old, state)
+        }
+        if state == WSConnected && onConnect != nil {
+            onConnect()
+        }
+        if old == WSConnected && onDisconnect != nil {
+            onDisconnect(cause)
+        }
+    }
+}
+
+// Subprotocol returns the subprotocol the server selected, or "" if none was
+// negotiated or the websocket is not connected
+func (ws *WebSocketConnection) Subprotocol() string {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    if ws.conn == nil {
+        return ""
+    }
+    return ws.conn.Subprotocol()
+}
+
+// IsConnected reports whether the websocket is currently connected
+func (ws *WebSocketConnection) IsConnected() bool {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    return ws.isConnected
+}
+
+// closeGracePeriod is how long Close waits for the peer to acknowledge a close frame
+const closeGracePeriod = time.Second
+
+// Close performs the websocket closing handshake: it sends a normal-closure frame,
+// waits briefly for the peer's reply and then closes the connection. It also stops
+// reconnection and keepalive. Close is idempotent; later sends return an error.
+func (ws *WebSocketConnection) Close() error {
+    ws.mu.Lock()
+    if ws.closed {
+        ws.mu.Unlock()
+        return nil
+    }
+    ws.closed = true
+    if ws.done != nil {
+        close(ws.done)
+    }
+    ws.detachPumpLocked()
+    conn, closeAck := ws.conn, ws.closeAck
+    ws.isConnected = false
+    notify := ws.transition(WSClosed, nil)
+    ws.mu.Unlock()
+    notify()
+
+    if conn == nil {
+        return nil
+    }
+
+    message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+    if err := ws.writeControl(conn, websocket.CloseMessage, message, time.Now().Add(closeGracePeriod)); err == nil {
+        ws.awaitCloseAck(conn, closeAck)
+    }
+    return conn.Close()
+}
+
+// awaitCloseAck waits up to closeGracePeriod for the peer's close frame. If another
+// goroutine is reading, its close handler signals closeAck; otherwise we read until
+// the handshake completes or the deadline passes.
+func (ws *WebSocketConnection) awaitCloseAck(conn *websocket.Conn, closeAck chan struct{}) {
+    if ws.readMu.TryLock() {
+        defer ws.readMu.Unlock()
+        conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }
+
+    timer := time.NewTimer(closeGracePeriod)
+    defer timer.Stop()
+    select {
+    case <-closeAck:
+    case <-timer.C:
+    }
+}
+
+// isClosed reports whether Close has been called
+func (ws *WebSocketConnection) isClosed() bool {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    return ws.closed
+}
+
+// markDisconnected flags the connection as dropped, because of cause, if conn is
+// still the active one
+func (ws *WebSocketConnection) markDisconnected(conn *websocket.Conn, cause error) {
+    ws.mu.Lock()
+    notify := func() {}
+    if ws.conn == conn && ws.isConnected {
+        ws.isConnected = false
+        if !ws.closed {
+            notify = ws.transition(WSDisconnected, cause)
+        }
+    }
+    ws.mu.Unlock()
+    notify()
+}
+
+// activeConn returns the current connection, or an error if there is none to use
+func (ws *WebSocketConnection) activeConn() (*websocket.Conn, error) {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    if ws.closed {
+        return nil, errWebSocketClosed
+    }
+    if ws.conn == nil {
+        return nil, fmt.Errorf("websocket not connected")
+    }
+    if !ws.isConnected && !ws.reconnect {
+        return nil, fmt.Errorf("websocket not connected")
+    }
+    return ws.conn, nil
+}
+
+// recoverFrom handles a failed read or write on conn by redialing when reconnect is enabled
+func (ws *WebSocketConnection) recoverFrom(conn *websocket.Conn, cause error) error {
+    ws.markDisconnected(conn, cause)
+    if ws.isClosed() {
+        // Close owns the connection for the rest of its handshake and closes it itself
+        return errWebSocketClosed
+    }
+    conn.Close()
+    if !ws.reconnect {
+        return cause
+    }
+    if err := ws.redial(conn); err != nil {
+        return fmt.Errorf("%v; %w", cause, err)
+    }
+    return nil
+}
+
+// redial reconnects with exponential backoff unless another caller already replaced failed
+func (ws *WebSocketConnection) redial(failed *websocket.Conn) error {
+    ws.reconnectMu.Lock()
+    defer ws.reconnectMu.Unlock()
+
+    ws.mu.Lock()
+    if ws.closed {
+        ws.mu.Unlock()
+        return errWebSocketClosed
+    }
+    if ws.conn != failed && ws.isConnected {
+        ws.mu.Unlock()
+        return nil
+    }
+    headers, done := ws.headers, ws.done
+    notify := ws.transition(WSReconnecting, nil)
+    ws.mu.Unlock()
+    notify()
+
+    maxAttempts := ws.maxReconnects
+    if maxAttempts <= 0 {
+        maxAttempts = defaultMaxReconnects
+    }
+    backoff := ExponentialBackoff{Base: 500 * time.Millisecond, Max: 30 * time.Second, Jitter: true}
+
+    var lastErr error
+    for attempt := 0; attempt < maxAttempts; attempt++ {
+        timer := time.NewTimer(backoff.NextDelay(attempt))
+        select {
+        case <-done:
+            timer.Stop()
+            return errWebSocketClosed
+        case <-timer.C:
+        }
+
+        if lastErr = ws.dial(headers); lastErr == nil {
+            ws.mu.Lock()
+            callback := ws.onReconnect
+            ws.mu.Unlock()
+            if callback != nil {
+                callback()
+            }
+            return nil
+        }
+        if errors.Is(lastErr, errWebSocketClosed) {
+            return lastErr
+        }
+    }
+
+    err := fmt.Errorf("websocket reconnect failed after %d attempts: %w", maxAttempts, lastErr)
+    ws.mu.Lock()
+    notify = func() {}
+    if !ws.closed {
+        notify = ws.transition(WSDisconnected, err)
+    }
+    ws.mu.Unlock()
+    notify()
+    return err
+}
+
+// SendMessage sends a text message through the websocket, redialing once if the
+// connection dropped. Use SendMessageWithType for binary frames.
+func (ws *WebSocketConnection) SendMessage(message []byte) error {
+    return ws.SendMessageWithType(websocket.TextMessage, message)
+}
+
+// SendMessageWithType sends data as a websocket.TextMessage or websocket.BinaryMessage
+// frame. Control frames are managed by the connection and are rejected.
+func (ws *WebSocketConnection) SendMessageWithType(messageType int, data []byte) error {
+    if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+        return fmt.Errorf("sending websocket message: unsupported message type %d", messageType)
+    }
+    return ws.write(func(conn *websocket.Conn) error {
+        return conn.WriteMessage(messageType, data)
+    })
+}
+
+// SendJSON marshals v and sends it as a text message
+func (ws *WebSocketConnection) SendJSON(v interface{}) error {
+    return ws.write(func(conn *websocket.Conn) error {
+        return conn.WriteJSON(v)
+    })
+}
+
+// write runs send against the active connection, redialing once if it dropped.
+// Marshaling failures are returned as-is since retrying cannot fix them.
+func (ws *WebSocketConnection) write(send func(*websocket.Conn) error) error {
+    for resent := false; ; resent = true {
+        conn, err := ws.activeConn()
+        if err != nil {
+            return err
+        }
+
+        ws.writeMu.Lock()
+        var deadline time.Time
+        if ws.writeTimeout > 0 {
+            deadline = time.Now().Add(ws.writeTimeout)
+        }
+        conn.SetWriteDeadline(deadline)
+        err = send(conn)
+        ws.writeMu.Unlock()
+        if err == nil {
+            return nil
+        }
+        if isMarshalError(err) {
+            return fmt.Errorf("encoding websocket JSON message: %w", err)
+        }
+
+        err = fmt.Errorf("sending websocket message: %w", err)
+        if resent {
+            ws.markDisconnected(conn, err)
+            conn.Close()
+            return err
+        }
+        if err := ws.recoverFrom(conn, err); err != nil {
+            return err
+        }
+    }
+}
+
+// writeControl sends a control frame under the same lock as data frames
+func (ws *WebSocketConnection) writeControl(conn *websocket.Conn, messageType int, data []byte, deadline time.Time) error {
+    ws.writeMu.Lock()
+    defer ws.writeMu.Unlock()
+    return conn.WriteControl(messageType, data, deadline)
+}
+
+// isMarshalError reports whether err came from encoding/json rather than the connection
+func isMarshalError(err error) bool {
+    var typeErr *json.UnsupportedTypeError
+    var valueErr *json.UnsupportedValueError
+    var marshalerErr *json.MarshalerError
+    return errors.As(err, &typeErr) || errors.As(err, &valueErr) || errors.As(err, &marshalerErr)
+}
+
+// ReadMessage blocks until a frame arrives and returns its type and payload.
+// With reconnect enabled, a dropped connection is redialed and the read resumes.
+func (ws *WebSocketConnection) ReadMessage() (messageType int, data []byte, err error) {
+    for {
+        conn, err := ws.activeConn()
+        if err != nil {
+            return 0, nil, err
+        }
+
+        ws.readMu.Lock()
+        messageType, data, err = conn.ReadMessage()
+        ws.readMu.Unlock()
+        if err == nil {
+            return messageType, data, nil
+        }
+
+        if err := ws.recoverFrom(conn, fmt.Errorf("reading websocket message: %w", err)); err != nil {
+            return 0, nil, err
+        }
+    }
+}
+
+// ReadJSON reads the next message and unmarshals it into v
+func (ws *WebSocketConnection) ReadJSON(v interface{}) error {
+    _, data, err := ws.ReadMessage()
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("decoding websocket JSON message: %w", err)
+    }
+    return nil
+}
+
+// Messages streams incoming frames from a background reader. It may be called
+// before Connect, in which case the reader starts once the connection is up. Do not
+// mix it with direct ReadMessage calls. The channel, and the one returned by Errors,
+// is closed when the connection is closed or fails for good. Calls made after that
+// return fresh channels fed by the next Connect, so take both channels up front.
+func (ws *WebSocketConnection) Messages() <-chan WSMessage {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.ensurePumpLocked()
+    return ws.messages
+}
+
+// Errors delivers the error that stopped the Messages reader, if any
+func (ws *WebSocketConnection) Errors() <-chan error {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+    ws.ensurePumpLocked()
+    return ws.errs
+}
+
+// ensurePumpLocked creates the Messages and Errors channels for the current
+// connection and starts their reader if already connected. ws.mu must be held.
+func (ws *WebSocketConnection) ensurePumpLocked() {
+    if ws.messages == nil {
+        size := ws.messageBuffer
+        if size < 0 {
+            size = 0
+        }
+        ws.messages = make(chan WSMessage, size)
+        ws.errs = make(chan error, 1)
+    }
+    ws.startPumpLocked()
+}
+
+// startPumpLocked launches the reader once per Connect, if Messages or Errors has
+// been called and the connection is up. ws.mu must be held.
+func (ws *WebSocketConnection) startPumpLocked() {
+    if ws.messages == nil || ws.pumpStarted || !ws.isConnected {
+        return
+    }
+    ws.pumpStarted = true
+    go ws.pump(ws.done, ws.messages, ws.errs)
+}
+
+// detachPumpLocked forgets a running reader's channels, which it closes as it exits,
+// so that later Messages and Errors calls bind to the next connection. ws.mu must
+// be held.
+func (ws *WebSocketConnection) detachPumpLocked() {
+    if ws.pumpStarted {
+        ws.messages, ws.errs = nil, nil
+        ws.pumpStarted = false
+    }
+}
+
+// pump reads frames into messages until reading fails permanently or done is closed
+func (ws *WebSocketConnection) pump(done chan struct{}, messages chan WSMessage, errs chan error) {
+    defer close(messages)
+    defer close(errs)
+    defer func() {
+        ws.mu.Lock()
+        if ws.messages == messages {
+            ws.detachPumpLocked()
+        }
+        ws.mu.Unlock()
+    }()
+
+    for !isDone(done) {
+        messageType, data, err := ws.ReadMessage()
+        if err != nil {
+            // A read interrupted by Close is a clean shutdown, not an error
+            if !errors.Is(err, errWebSocketClosed) && !isDone(done) {
+                errs <- err
+            }
+            return
+        }
+
+        message := WSMessage{Type: messageType, Data: data}
+        if ws.dropOnFull {
+            select {
+            case messages <- message:
+            default:
+            }
+            continue
+        }
+
+        select {
+        case messages <- message:
+        case <-done:
+            return
+        }
+    }
+}
+
+// isDone reports whether done has been closed
+func isDone(done chan struct{}) bool {
+    select {
+    case <-done:
+        return true
+    default:
+        return false
+    }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "container/list"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultCacheEntries sizes the cache created implicitly by WithConditionalRequests
+const defaultCacheEntries = 256
+
+// responseCache is an LRU of fresh GET responses keyed by URL and Vary'd request headers
+type responseCache struct {
+    maxEntries  int
+    conditional bool // keep stale entries that carry an ETag for revalidation
+
+    mu      sync.Mutex
+    lru     *list.List               // front is most recently used
+    entries map[string]*list.Element // cache key -> *cacheEntry element
+    vary    map[string][]string      // URL -> header names from the last Vary seen
+}
+
+// cacheEntry is a stored response and when it stops being fresh
+type cacheEntry struct {
+    key     string
+    resp    *Response
+    expires time.Time
+}
+
+// newResponseCache creates a cache holding at most maxEntries responses
+func newResponseCache(maxEntries int) *responseCache {
+    return &responseCache{
+        maxEntries: maxEntries,
+        lru:        list.New(),
+        entries:    make(map[string]*list.Element),
+        vary:       make(map[string][]string),
+    }
+}
+
+// get returns a copy of a fresh cached response for url and the request headers
+func (rc *responseCache) get(url string, header http.Header) (*Response, bool) {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+
+    key := cacheKey(url, rc.vary[url], header)
+    elem, ok := rc.entries[key]
+    if !ok {
+        return nil, false
+    }
+
+    entry := elem.Value.(*cacheEntry)
+    if time.Now().After(entry.expires) {
+        if !rc.conditional || entry.resp.Headers.Get("ETag") == "" {
+            rc.lru.Remove(elem)
+            delete(rc.entries, key)
+        }
+        return nil, false
+    }
+
+    rc.lru.MoveToFront(elem)
+    return entry.resp.cachedCopy(), true
+}
+
+// validator returns the ETag of a stored, possibly stale, response for revalidation
+func (rc *responseCache) validator(url string, header http.Header) (string, bool) {
+    if !rc.conditional {
+        return "", false
+    }
+
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+
+    elem, ok := rc.entries[cacheKey(url, rc.vary[url], header)]
+    if !ok {
+        return "", false
+    }
+    etag := elem.Value.(*cacheEntry).resp.Headers.Get("ETag")
+    return etag, etag != ""
+}
+
+// revalidate handles a 304 by refreshing the stored entry's freshness from the
+// 304 headers and returning its body
+func (rc *responseCache) revalidate(url string, header http.Header, notModified *Response) (*Response, bool) {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+
+    elem, ok := rc.entries[cacheKey(url, rc.vary[url], header)]
+    if !ok {
+        return nil, false
+    }
+
+    entry := elem.Value.(*cacheEntry)
+    if expires, ok := freshUntil(notModified.Headers, time.Now()); ok {
+        entry.expires = expires
+    }
+    rc.lru.MoveToFront(elem)
+
+    cached := entry.resp.cachedCopy()
+    cached.NotModified = true
+    return cached, true
+}
+
+// put stores resp if its status and caching headers allow it
+func (rc *responseCache) put(url string, header http.Header, resp *Response) {
+    if resp.StatusCode != http.StatusOK {
+        return
+    }
+
+    varyNames, ok := parseVary(resp.Headers)
+    if !ok {
+        return
+    }
+    expires, fresh := freshUntil(resp.Headers, time.Now())
+    if !fresh && !(rc.conditional && resp.Headers.Get("ETag") != "" && !noStore(resp.Headers)) {
+        return
+    }
+
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+
+    rc.vary[url] = varyNames
+    key := cacheKey(url, varyNames, header)
+    entry := &cacheEntry{key: key, resp: resp.cachedCopy(), expires: expires}
+
+    if elem, ok := rc.entries[key]; ok {
+        elem.Value = entry
+        rc.lru.MoveToFront(elem)
+        return
+    }
+
+    rc.entries[key] = rc.lru.PushFront(entry)
+    for rc.maxEntries > 0 && rc.lru.Len() > rc.maxEntries {
+        oldest := rc.lru.Back()
+        rc.lru.Remove(oldest)
+        delete(rc.entries, oldest.Value.(*cacheEntry).key)
+    }
+}
+
+// cachedCopy returns a copy of r flagged as served from cache
+func (r *Response) cachedCopy() *Response {
+    body := make([]byte, len(r.Body))
+    copy(body, r.Body)
+    return &Response{
+        StatusCode: r.StatusCode,
+        Body:       body,
+        Headers:    r.Headers.Clone(),
+        FromCache:  true,
+        Proto:      r.Proto,
+        Redirects:  r.Redirects,
+    }
+}
+
+// cacheKey combines the URL with the request's values for each Vary header
+func cacheKey(url string, varyNames []string, header http.Header) string {
+    var b strings.Builder
+    b.WriteString(url)
+    for _, name := range varyNames {
+        b.WriteString("\n")
+        b.WriteString(name)
+        b.WriteString(":")
+        b.WriteString(strings.Join(header.Values(name), ","))
+    }
+    return b.String()
+}
+
+// parseVary returns the canonical Vary header names; ok is false for "Vary: *"
+func parseVary(header http.Header) ([]string, bool) {
+    var names []string
+    for _, value := range header.Values("Vary") {
+        for _, name := range strings.Split(value, ",") {
+            name = strings.TrimSpace(name)
+            if name == "*" {
+                return nil, false
+            }
+            if name != "" {
+                names = append(names, http.CanonicalHeaderKey(name))
+            }
+        }
+    }
+    return names, true
+}
+
+// noStore reports whether Cache-Control forbids storing the response at all
+func noStore(header http.Header) bool {
+    for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+        if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+            return true
+        }
+    }
+    return false
+}
+
+// freshUntil computes expiry from Cache-Control max-age or Expires; ok is false
+// when the response must not be cached or carries no freshness information
+func freshUntil(header http.Header, now time.Time) (time.Time, bool) {
+    maxAge := -1
+    for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+        directive = strings.ToLower(strings.TrimSpace(directive))
+        switch {
+        case directive == "no-store", directive == "no-cache":
+            return time.Time{}, false
+        case strings.HasPrefix(directive, "max-age="):
+            seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+            if err != nil {
+                return time.Time{}, false
+            }
+            maxAge = seconds
+        }
+    }
+    if maxAge == 0 {
+        return time.Time{}, false
+    }
+    if maxAge > 0 {
+        return now.Add(time.Duration(maxAge) * time.Second), true
+    }
+
+    if expires := header.Get("Expires"); expires != "" {
+        t, err := http.ParseTime(expires)
+        if err != nil || !t.After(now) {
+            return time.Time{}, false
+        }
+        return t, true
+    }
+    return time.Time{}, false
+}
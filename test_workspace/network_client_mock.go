@@ -0,0 +1,187 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// ErrNoMockResponse is returned by MockTransport for requests with no registered response
+var ErrNoMockResponse = errors.New("no mock response registered")
+
+// MockTransport is an in-memory http.RoundTripper for testing HTTPClient consumers
+// without a server. Responses are registered per method and path; several responses
+// for the same route are served in order and the last one repeats, so
+//
+//	mock.RespondStatus("GET", "/users", 503)
+//	mock.Respond("GET", "/users", 200, `{"id":1}`, nil)
+//
+// fails once and then succeeds. Install it with WithTransport.
+type MockTransport struct {
+    mu       sync.Mutex
+    routes   map[string][]mockReply // "METHOD /path" -> replies still to serve
+    requests []CapturedRequest
+}
+
+// mockReply is a canned response or a simulated transport error
+type mockReply struct {
+    status  int
+    body    []byte
+    headers map[string]string
+    err     error
+}
+
+// CapturedRequest is a request seen by a MockTransport, with its body already read
+type CapturedRequest struct {
+    Method string
+    URL    *url.URL
+    Header http.Header
+    Body   []byte
+}
+
+// mockTimeoutError looks like a transport timeout to the client and to callers
+// checking net.Error
+type mockTimeoutError struct{}
+
+func (mockTimeoutError) Error() string   { return "mock: i/o timeout" }
+func (mockTimeoutError) Timeout() bool   { return true }
+func (mockTimeoutError) Temporary() bool { return true }
+
+// NewMockTransport creates a MockTransport with no registered responses
+func NewMockTransport() *MockTransport {
+    return &MockTransport{routes: make(map[string][]mockReply)}
+}
+
+// Respond queues a response for method and path (the query string is not matched)
+func (m *MockTransport) Respond(method, path string, status int, body string, headers map[string]string) {
+    m.add(method, path, mockReply{status: status, body: []byte(body), headers: headers})
+}
+
+// RespondJSON queues a response with a JSON Content-Type
+func (m *MockTransport) RespondJSON(method, path string, status int, body string) {
+    m.Respond(method, path, status, body, map[string]string{"Content-Type": "application/json"})
+}
+
+// RespondStatus queues an empty response with the given status code
+func (m *MockTransport) RespondStatus(method, path string, status int) {
+    m.Respond(method, path, status, "", nil)
+}
+
+// RespondError queues a network error, as if the connection failed
+func (m *MockTransport) RespondError(method, path string, err error) {
+    m.add(method, path, mockReply{err: err})
+}
+
+// RespondTimeout queues a timeout error that satisfies net.Error with Timeout() true
+func (m *MockTransport) RespondTimeout(method, path string) {
+    m.add(method, path, mockReply{err: mockTimeoutError{}})
+}
+
+// add appends reply to the queue for method and path
+func (m *MockTransport) add(method, path string, reply mockReply) {
+    key := mockKey(method, path)
+    m.mu.Lock()
+    m.routes[key] = append(m.routes[key], reply)
+    m.mu.Unlock()
+}
+
+// Requests returns every request seen so far, in order
+func (m *MockTransport) Requests() []CapturedRequest {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := make([]CapturedRequest, len(m.requests))
+    copy(out, m.requests)
+    return out
+}
+
+// Calls counts the requests seen for method and path
+func (m *MockTransport) Calls(method, path string) int {
+    key := mockKey(method, path)
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    n := 0
+    for _, req := range m.requests {
+        if mockKey(req.Method, req.URL.Path) == key {
+            n++
+        }
+    }
+    return n
+}
+
+// Reset drops registered responses and captured requests
+func (m *MockTransport) Reset() {
+    m.mu.Lock()
+    m.routes = make(map[string][]mockReply)
+    m.requests = nil
+    m.mu.Unlock()
+}
+
+// RoundTrip implements http.RoundTripper
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    var body []byte
+    if req.Body != nil {
+        var err error
+        body, err = ioutil.ReadAll(req.Body)
+        req.Body.Close()
+        if err != nil {
+            return nil, fmt.Errorf("reading request body: %w", err)
+        }
+    }
+
+    key := mockKey(req.Method, req.URL.Path)
+    m.mu.Lock()
+    u := *req.URL
+    m.requests = append(m.requests, CapturedRequest{
+        Method: req.Method,
+        URL:    &u,
+        Header: req.Header.Clone(),
+        Body:   body,
+    })
+    replies := m.routes[key]
+    var reply mockReply
+    ok := len(replies) > 0
+    if ok {
+        reply = replies[0]
+        if len(replies) > 1 {
+            m.routes[key] = replies[1:]
+        }
+    }
+    m.mu.Unlock()
+
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", key, ErrNoMockResponse)
+    }
+    if reply.err != nil {
+        return nil, reply.err
+    }
+
+    header := make(http.Header, len(reply.headers))
+    for k, v := range reply.headers {
+        header.Set(k, v)
+    }
+    return &http.Response{
+        Status:        strconv.Itoa(reply.status) + " " + http.StatusText(reply.status),
+        StatusCode:    reply.status,
+        Proto:         "HTTP/1.1",
+        ProtoMajor:    1,
+        ProtoMinor:    1,
+        Header:        header,
+        Body:          ioutil.NopCloser(bytes.NewReader(reply.body)),
+        ContentLength: int64(len(reply.body)),
+        Request:       req,
+    }, nil
+}
+
+// mockKey is the route key for method and path, e.g. "GET /users"
+func mockKey(method, path string) string {
+    if path == "" {
+        path = "/"
+    }
+    return strings.ToUpper(method) + " " + path
+}
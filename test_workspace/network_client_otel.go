@@ -0,0 +1,66 @@
+//go:build otel
+
+package main
+
+import (
+    "context"
+    "net/http"
+
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// WithTracing records a client span per call when the request context carries a span,
+// and injects W3C traceparent headers into every attempt
+func WithTracing(provider trace.TracerProvider) Option {
+    return func(c *HTTPClient) {
+        c.tracer = &otelTracer{
+            tracer:     provider.Tracer("network_client"),
+            propagator: propagation.TraceContext{},
+        }
+    }
+}
+
+// otelTracer implements callTracer with OpenTelemetry
+type otelTracer struct {
+    tracer     trace.Tracer
+    propagator propagation.TextMapPropagator
+}
+
+// start opens a child span if ctx already carries one; otherwise it is a no-op
+func (t *otelTracer) start(ctx context.Context, method, url string) (context.Context, func(*http.Response, int, error)) {
+    if !trace.SpanContextFromContext(ctx).IsValid() {
+        return ctx, func(*http.Response, int, error) {}
+    }
+
+    ctx, span := t.tracer.Start(ctx, method,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("http.request.method", method),
+            attribute.String("url.full", url),
+        ),
+    )
+
+    return ctx, func(resp *http.Response, attempts int, err error) {
+        defer span.End()
+
+        span.SetAttributes(attribute.Int("http.client.attempts", attempts))
+        if err != nil {
+            span.RecordError(err)
+            span.SetStatus(codes.Error, err.Error())
+            return
+        }
+
+        span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+        if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+            span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+        }
+    }
+}
+
+// inject writes the span context from ctx into the outgoing headers
+func (t *otelTracer) inject(ctx context.Context, header http.Header) {
+    t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// latencySamples is how many recent attempt latencies are kept per host for percentiles
+const latencySamples = 1024
+
+// HostStats summarizes the attempts sent to one host since the client was created
+type HostStats struct {
+    Requests int64         // attempts sent, including retries
+    Errors   int64         // attempts that got no response
+    Slow     int64         // attempts over the WithSlowRequestThreshold threshold
+    Total    time.Duration // summed latency of all attempts
+    Max      time.Duration
+    P50      time.Duration // over the most recent latencySamples attempts
+    P99      time.Duration
+}
+
+// Mean is the average attempt latency, or zero before any attempt
+func (s HostStats) Mean() time.Duration {
+    if s.Requests == 0 {
+        return 0
+    }
+    return s.Total / time.Duration(s.Requests)
+}
+
+// WithSlowRequestThreshold calls onSlow after any attempt that takes longer than d,
+// with the request that was sent. onSlow runs on the calling goroutine, so it should
+// hand off anything expensive such as paging.
+func WithSlowRequestThreshold(d time.Duration, onSlow func(*http.Request, time.Duration)) Option {
+    if d <= 0 {
+        panic(fmt.Sprintf("WithSlowRequestThreshold: threshold must be positive, got %v", d))
+    }
+    return func(c *HTTPClient) {
+        c.slowThreshold = d
+        c.onSlow = onSlow
+    }
+}
+
+// Stats returns per-host latency counters keyed by host[:port]
+func (c *HTTPClient) Stats() map[string]HostStats {
+    return c.stats.snapshot()
+}
+
+// hostStatsTracker aggregates attempt latencies per host
+type hostStatsTracker struct {
+    mu    sync.Mutex
+    hosts map[string]*hostCounters
+}
+
+// hostCounters is the running state behind one HostStats
+type hostCounters struct {
+    stats   HostStats
+    samples []time.Duration // ring buffer of recent latencies
+    next    int
+}
+
+// newHostStatsTracker creates a tracker with no hosts recorded yet
+func newHostStatsTracker() *hostStatsTracker {
+    return &hostStatsTracker{hosts: make(map[string]*hostCounters)}
+}
+
+// record adds one attempt to host's counters and latency samples
+func (t *hostStatsTracker) record(host string, latency time.Duration, failed, slow bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    h, ok := t.hosts[host]
+    if !ok {
+        h = &hostCounters{}
+        t.hosts[host] = h
+    }
+    h.stats.Requests++
+    if failed {
+        h.stats.Errors++
+    }
+    if slow {
+        h.stats.Slow++
+    }
+    h.stats.Total += latency
+    if latency > h.stats.Max {
+        h.stats.Max = latency
+    }
+
+    if len(h.samples) < latencySamples {
+        h.samples = append(h.samples, latency)
+        return
+    }
+    h.samples[h.next] = latency
+    h.next = (h.next + 1) % latencySamples
+}
+
+// snapshot copies every host's counters and computes their percentiles
+func (t *hostStatsTracker) snapshot() map[string]HostStats {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    out := make(map[string]HostStats, len(t.hosts))
+    for host, h := range t.hosts {
+        stats := h.stats
+        sorted := make([]time.Duration, len(h.samples))
+        copy(sorted, h.samples)
+        sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+        stats.P50 = percentile(sorted, 50)
+        stats.P99 = percentile(sorted, 99)
+        out[host] = stats
+    }
+    return out
+}
+
+// percentile picks the nearest-rank value from ascending samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    rank := (p*len(sorted) + 99) / 100
+    if rank < 1 {
+        rank = 1
+    }
+    return sorted[rank-1]
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io/fs"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestJoinURL(t *testing.T) {
+    tests := []struct {
+        base, endpoint, want string
+    }{
+        {"https://api.example.com", "users", "https://api.example.com/users"},
+        {"https://api.example.com", "/users", "https://api.example.com/users"},
+        {"https://api.example.com/", "users", "https://api.example.com/users"},
+        {"https://api.example.com/", "/users", "https://api.example.com/users"},
+        {"https://api.example.com/v1//", "//users", "https://api.example.com/v1/users"},
+        {"https://api.example.com/v1", "", "https://api.example.com/v1"},
+        {"https://api.example.com/v1/", "", "https://api.example.com/v1/"},
+        {"https://api.example.com/search", "?q=go", "https://api.example.com/search?q=go"},
+        {"", "/users", "/users"},
+    }
+
+    for _, tt := range tests {
+        if got := joinURL(tt.base, tt.endpoint); got != tt.want {
+            t.Errorf("joinURL(%q, %q) = %q, want %q", tt.base, tt.endpoint, got, tt.want)
+        }
+    }
+}
+
+func TestWithoutRetriesMakesOneCall(t *testing.T) {
+    var calls int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&calls, 1)
+        w.Header().Set("Retry-After", "5")
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer srv.Close()
+
+    client := NewHTTPClient(srv.URL, 10*time.Second, WithoutRetries())
+    start := time.Now()
+    resp, err := client.GET("/", nil)
+    elapsed := time.Since(start)
+
+    if err != nil {
+        t.Fatalf("GET: %v", err)
+    }
+    if resp.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+    }
+    if n := atomic.LoadInt32(&calls); n != 1 {
+        t.Errorf("server saw %d calls, want 1", n)
+    }
+    // Honoring Retry-After would sleep for 5s before a retry that must not happen
+    if elapsed > time.Second {
+        t.Errorf("GET took %v, want no retry delay", elapsed)
+    }
+}
+
+func TestPostMultipartBadURLReleasesWriter(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "upload.txt")
+    if err := ioutil.WriteFile(path, []byte("payload"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    // The invalid host makes building the request fail after the body pipe has started
+    client := NewHTTPClient("http://bad host", time.Second, WithoutRetries())
+    files := map[string]string{"file": path}
+
+    client.PostMultipart("/upload", nil, files, nil)
+    before := runtime.NumGoroutine()
+    for i := 0; i < 20; i++ {
+        if _, err := client.PostMultipart("/upload", nil, files, nil); err == nil {
+            t.Fatal("PostMultipart to an invalid URL succeeded")
+        }
+    }
+
+    // Give released writers a moment to return
+    deadline := time.Now().Add(time.Second)
+    for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if after := runtime.NumGoroutine(); after > before {
+        t.Errorf("goroutines grew from %d to %d across failed uploads", before, after)
+    }
+}
+
+func TestMessagesAfterCloseBindsToNextConnection(t *testing.T) {
+    upgrader := websocket.Upgrader{}
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }))
+    defer srv.Close()
+
+    ws := NewWebSocketConnection("ws" + strings.TrimPrefix(srv.URL, "http"))
+    if err := ws.Connect(); err != nil {
+        t.Fatalf("Connect: %v", err)
+    }
+    first := ws.Messages()
+    if err := ws.Close(); err != nil {
+        t.Fatalf("Close: %v", err)
+    }
+    for range first {
+    }
+
+    messages := ws.Messages()
+    if err := ws.Connect(); err != nil {
+        t.Fatalf("reconnect: %v", err)
+    }
+    defer ws.Close()
+
+    select {
+    case msg, ok := <-messages:
+        if !ok {
+            t.Fatal("Messages channel taken after Close was already closed")
+        }
+        if string(msg.Data) != "hello" {
+            t.Errorf("message = %q, want %q", msg.Data, "hello")
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("no message from the new connection")
+    }
+}
+
+func TestBadTLSFilesFailRequests(t *testing.T) {
+    var calls int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&calls, 1)
+    }))
+    defer srv.Close()
+
+    dir := t.TempDir()
+    notPEM := filepath.Join(dir, "ca.pem")
+    if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    missing := filepath.Join(dir, "missing.pem")
+
+    tests := []struct {
+        name    string
+        opt     Option
+        missing bool
+    }{
+        {"missing CA file", WithRootCAs(missing), true},
+        {"CA file without certificates", WithRootCAs(notPEM), false},
+        {"missing key pair", WithClientCertificate(missing, missing), true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := NewHTTPClient(srv.URL, time.Second, tt.opt)
+            _, err := client.GET("/", nil)
+
+            var reqErr *RequestError
+            if !errors.As(err, &reqErr) {
+                t.Fatalf("GET error = %v, want a *RequestError", err)
+            }
+            if tt.missing && !errors.Is(err, fs.ErrNotExist) {
+                t.Errorf("GET error = %v, want it to wrap fs.ErrNotExist", err)
+            }
+        })
+    }
+    if n := atomic.LoadInt32(&calls); n != 0 {
+        t.Errorf("server saw %d calls, want none", n)
+    }
+}
+
+func TestAPIErrorBodySurvivesRelease(t *testing.T) {
+    var calls int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusBadRequest)
+        if atomic.AddInt32(&calls, 1) == 1 {
+            w.Write([]byte(`{"error":"first"}`))
+        } else {
+            w.Write([]byte(`{"error":"other"}`))
+        }
+    }))
+    defer srv.Close()
+
+    client := NewHTTPClient(srv.URL, time.Second, WithBufferPool(), WithoutRetries(),
+        WithErrorResponse(func() interface{} { return new(map[string]string) }))
+
+    resp, err := client.GET("/", nil)
+    var apiErr *APIError
+    if !errors.As(err, &apiErr) {
+        t.Fatalf("GET error = %v, want an *APIError", err)
+    }
+    resp.Release()
+
+    // Reuses the released buffer when the pool hands it back
+    if resp, _ := client.GET("/", nil); resp != nil {
+        defer resp.Release()
+    }
+    if got := string(apiErr.Body); got != `{"error":"first"}` {
+        t.Errorf("APIError.Body after Release = %q, want the first response", got)
+    }
+}
+
+func TestResponseTooLargeIsRequestError(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write(bytes.Repeat([]byte("x"), 1024))
+    }))
+    defer srv.Close()
+
+    client := NewHTTPClient(srv.URL, time.Second, WithMaxResponseSize(100))
+    _, err := client.GET("/", nil)
+
+    if !errors.Is(err, ErrResponseTooLarge) {
+        t.Fatalf("GET error = %v, want it to wrap ErrResponseTooLarge", err)
+    }
+    var reqErr *RequestError
+    if !errors.As(err, &reqErr) {
+        t.Fatalf("GET error = %v, want a *RequestError", err)
+    }
+    if reqErr.StatusCode != http.StatusOK || reqErr.Attempts != 1 {
+        t.Errorf("RequestError status %d after %d attempts, want 200 after 1", reqErr.StatusCode, reqErr.Attempts)
+    }
+}
+
+func BenchmarkParseResponse(b *testing.B) {
+    payload := bytes.Repeat([]byte("x"), 64<<10)
+    benchmarks := []struct {
+        name string
+        opts []Option
+    }{
+        {"NoPool", nil},
+        {"BufferPool", []Option{WithBufferPool()}},
+    }
+
+    for _, bm := range benchmarks {
+        b.Run(bm.name, func(b *testing.B) {
+            client := NewHTTPClient("http://example.com", time.Second, bm.opts...)
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                resp := &http.Response{
+                    StatusCode: http.StatusOK,
+                    Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+                    Body:       ioutil.NopCloser(bytes.NewReader(payload)),
+                }
+                parsed, err := client.parseResponse(resp)
+                if err != nil {
+                    b.Fatal(err)
+                }
+                parsed.Release()
+            }
+        })
+    }
+}